@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access log formats
+const (
+	combinedFormat = "combined"
+	jsonFormat     = "json"
+	logfmtFormat   = "logfmt"
+)
+
+func validLogFormat(format string) error {
+	switch format {
+	case combinedFormat, jsonFormat, logfmtFormat:
+		return nil
+	}
+	return fmt.Errorf("Unknown access log format '%s' (%s, %s, %s)", format, combinedFormat, jsonFormat, logfmtFormat)
+}
+
+// AccessLog writes a line per request once it is served, and per websocket
+// session once it is closed.
+type AccessLog struct {
+	// Format is combined (the Combined Log Format followed by the gateway's
+	// own fields), json or logfmt
+	Format string
+	Output io.Writer
+
+	mu sync.Mutex
+}
+
+// accessEntry holds the fields of an access log line
+type accessEntry struct {
+	Time          time.Time `json:"time"`
+	RequestID     string    `json:"request_id,omitempty"`
+	RemoteAddr    string    `json:"remote_addr"`
+	User          string    `json:"user,omitempty"`
+	Method        string    `json:"method"`
+	Host          string    `json:"host"`
+	URI           string    `json:"uri"`
+	Proto         string    `json:"proto"`
+	Status        int       `json:"status"`
+	Bytes         int64     `json:"bytes"`
+	Referer       string    `json:"referer,omitempty"`
+	UserAgent     string    `json:"user_agent,omitempty"`
+	Duration      float64   `json:"duration_ms"`
+	Upstream      float64   `json:"upstream_ms"`
+	Destination   string    `json:"destination,omitempty"`
+	Route         string    `json:"route,omitempty"`
+	Stack         string    `json:"stack,omitempty"`
+	Retries       int       `json:"retries,omitempty"`
+	Websocket     bool      `json:"websocket,omitempty"`
+	BytesIn       int64     `json:"bytes_in,omitempty"`
+	TLSVersion    string    `json:"tls_version,omitempty"`
+	TLSCipher     string    `json:"tls_cipher,omitempty"`
+	TLSServerName string    `json:"tls_server_name,omitempty"`
+}
+
+// Wrap returns a handler logging every request served by h.
+func (l *AccessLog) Wrap(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r, info := withRequestInfo(r)
+		started := time.Now()
+		rw := &recordingResponseWriter{ResponseWriter: w, body: &captureBuffer{}}
+
+		h(rw, r)
+
+		e := accessEntry{
+			Time:        started,
+			RequestID:   info.RequestID,
+			RemoteAddr:  stripPort(r.RemoteAddr),
+			Method:      r.Method,
+			Host:        r.Host,
+			URI:         r.URL.RequestURI(),
+			Proto:       r.Proto,
+			Status:      rw.statusCode(),
+			Bytes:       rw.body.size,
+			Referer:     r.Referer(),
+			UserAgent:   r.UserAgent(),
+			Duration:    milliseconds(time.Since(started)),
+			Upstream:    milliseconds(info.UpstreamLatency),
+			Destination: info.Destination,
+			Route:       info.RouteName,
+			Stack:       info.Stack,
+			Retries:     info.Retries,
+			Websocket:   rw.hijacked,
+		}
+		e.User, _, _ = r.BasicAuth()
+		if rw.hijacked {
+			e.BytesIn, e.Bytes = info.WebsocketBytesIn, info.WebsocketBytesOut
+		}
+		if r.TLS != nil {
+			e.TLSVersion = tlsVersion(r.TLS.Version)
+			e.TLSCipher = fmt.Sprintf("0x%04x", r.TLS.CipherSuite)
+			e.TLSServerName = r.TLS.ServerName
+		}
+		l.write(e)
+	}
+}
+
+func (l *AccessLog) write(e accessEntry) {
+	var line []byte
+	switch l.Format {
+	case jsonFormat:
+		line, _ = json.Marshal(e)
+	case logfmtFormat:
+		line = e.logfmt()
+	default:
+		line = e.combined()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Output.Write(append(line, '\n'))
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func tlsVersion(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// dash stands for empty values in the Combined Log Format
+func dash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// escape makes a value the client sent safe to write in a log line, escaping
+// quotes, backslashes and control characters as strconv.Quote does
+func escape(value string) string {
+	quoted := strconv.Quote(value)
+	return quoted[1 : len(quoted)-1]
+}
+
+// combined formats the entry in the Combined Log Format, followed by the
+// route, destination, request and upstream durations, TLS version and
+// request id.
+func (e *accessEntry) combined() []byte {
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.FormatInt(e.Bytes, 10)
+	}
+	return []byte(fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %s %q %q %q %q %.3fms %.3fms %s %s`,
+		e.RemoteAddr, dash(escape(e.User)), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		escape(e.Method), escape(e.URI), escape(e.Proto), e.Status, size, dash(e.Referer), dash(e.UserAgent),
+		dash(e.Route), dash(e.Destination), e.Duration, e.Upstream, dash(e.TLSVersion), dash(e.RequestID)))
+}
+
+// logfmt formats the entry as key=value pairs, leaving empty values out
+func (e *accessEntry) logfmt() []byte {
+	var b bytes.Buffer
+	add := func(key, value string) {
+		if value == "" {
+			return
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(key)
+		b.WriteByte('=')
+		if strings.ContainsAny(value, " =") || escape(value) != value {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(value)
+	}
+	add("time", e.Time.Format(time.RFC3339Nano))
+	add("request_id", e.RequestID)
+	add("remote_addr", e.RemoteAddr)
+	add("user", e.User)
+	add("method", e.Method)
+	add("host", e.Host)
+	add("uri", e.URI)
+	add("proto", e.Proto)
+	add("status", strconv.Itoa(e.Status))
+	add("bytes", strconv.FormatInt(e.Bytes, 10))
+	add("referer", e.Referer)
+	add("user_agent", e.UserAgent)
+	add("duration_ms", strconv.FormatFloat(e.Duration, 'f', 3, 64))
+	add("upstream_ms", strconv.FormatFloat(e.Upstream, 'f', 3, 64))
+	add("destination", e.Destination)
+	add("route", e.Route)
+	add("stack", e.Stack)
+	if e.Retries > 0 {
+		add("retries", strconv.Itoa(e.Retries))
+	}
+	if e.Websocket {
+		add("websocket", "true")
+		add("bytes_in", strconv.FormatInt(e.BytesIn, 10))
+	}
+	add("tls_version", e.TLSVersion)
+	add("tls_cipher", e.TLSCipher)
+	add("tls_server_name", e.TLSServerName)
+	return b.Bytes()
+}
+
+// rotatingFile is an append only log file, rotated once it grows past
+// maxSize: the file is renamed to path.1, path.1 to path.2 and so on, keeping
+// maxBackups of them.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	return f, f.open()
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		// lines keep going to the current file when it cannot be rotated,
+		// until it grew by maxSize again
+		if err := f.rotate(); err != nil {
+			log.Printf("Unable to rotate %s: %v", f.path, err)
+			f.size = 0
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file aside and opens a new one. The current file is only
+// closed once the new one is open.
+func (f *rotatingFile) rotate() error {
+	current := f.file
+	if f.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxBackups))
+		for n := f.maxBackups - 1; n > 0; n-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, n), fmt.Sprintf("%s.%d", f.path, n+1))
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	current.Close()
+	return nil
+}
+
+// accessLogOutput opens where the access log goes: stdout, stderr or a file
+func accessLogOutput(output string, maxSize int64, maxBackups int) (io.Writer, error) {
+	switch output {
+	case "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	}
+	return openRotatingFile(output, maxSize, maxBackups)
+}
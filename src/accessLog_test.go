@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func loggedRequest(t *testing.T, format string) string {
+	var out bytes.Buffer
+	log := &AccessLog{Format: format, Output: &out}
+	handler := withRequestID(log.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		info := requestInfo(r)
+		info.RouteName, info.Destination = "shop", "10.0.0.2:80"
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	r := httptest.NewRequest("POST", "http://shop.example.test/orders?id=1", nil)
+	r.Header.Set("User-Agent", "test agent")
+	r.Header.Set("X-Request-ID", "order-42")
+	handler(httptest.NewRecorder(), r)
+	return out.String()
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	combined := loggedRequest(t, combinedFormat)
+	pattern := `^192\.0\.2\.1 - - \[[^\]]+\] "POST /orders\?id=1 HTTP/1\.1" 201 7 "-" "test agent" "shop" "10\.0\.0\.2:80" [0-9.]+ms [0-9.]+ms - order-42\n$`
+	if !regexp.MustCompile(pattern).MatchString(combined) {
+		t.Errorf("Unexpected combined log line: %q", combined)
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(loggedRequest(t, jsonFormat)), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["status"] != 201.0 || entry["request_id"] != "order-42" || entry["route"] != "shop" || entry["destination"] != "10.0.0.2:80" || entry["bytes"] != 7.0 {
+		t.Errorf("Unexpected json log entry: %v", entry)
+	}
+
+	logfmt := loggedRequest(t, logfmtFormat)
+	for _, field := range []string{"method=POST", "host=shop.example.test", "status=201", `user_agent="test agent"`, "route=shop", "request_id=order-42"} {
+		if !strings.Contains(logfmt, " "+field) {
+			t.Errorf("Expected %s in the logfmt line, got: %q", field, logfmt)
+		}
+	}
+}
+
+func TestAccessLogEscapes(t *testing.T) {
+	forged := "/\" 200 1 \"-\" \"-\"\n10.0.0.1 - - [01/Jan/2030:00:00:00 +0000] \"GET /admin"
+	e := &accessEntry{Method: "GET", URI: forged, Proto: "HTTP/1.1", User: "ops\nroot", Status: 200}
+	if line := string(e.combined()); strings.Contains(line, "\n") || !strings.Contains(line, `"GET /\" 200 1 \"-\" \"-\"\n10.0.0.1`) || !strings.Contains(line, ` ops\nroot `) {
+		t.Errorf("Expected the request and user to be escaped in the combined line, got %q", line)
+	}
+	if line := string(e.logfmt()); strings.Contains(line, "\n") || !strings.Contains(line, `user="ops\nroot"`) {
+		t.Errorf("Expected the user to be quoted in the logfmt line, got %q", line)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "access-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	f, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		f.Write([]byte(line))
+	}
+	for file, content := range map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n"} {
+		if data, _ := ioutil.ReadFile(file); string(data) != content {
+			t.Errorf("Expected %s to hold %q, got %q", filepath.Base(file), content, data)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 backups to be kept")
+	}
+}
+
+func TestRotatingFileKeepsWritingWhenRotationFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "access-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	// the log cannot be renamed over a directory that is not empty
+	if err := os.MkdirAll(filepath.Join(path+".1", "busy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := openRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Errorf("Expected %q to be written, got %v", line, err)
+		}
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "first\nsecond\nthird\n" {
+		t.Errorf("Expected the lines to stay in the current file, got %q", data)
+	}
+}
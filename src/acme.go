@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACME challenge types
+const (
+	http01    = "http-01"
+	tlsALPN01 = "tls-alpn-01"
+)
+
+// letsEncryptStagingURL is the directory -acme-directory=staging stands for
+const letsEncryptStagingURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+// ACMEConfig tells which ACME server certificates are requested from, and
+// how the gateway proves it serves the hosts.
+type ACMEConfig struct {
+	// Directory is the directory URL of the ACME server, Let's Encrypt
+	// production when empty and Let's Encrypt staging for "staging"
+	Directory string
+	// Email is the contact of the account, told about expiring certificates
+	Email string
+	// EABKeyID and EABKey (base64url encoded) bind the account to an account
+	// of the CA, for CAs requiring external account binding
+	EABKeyID string
+	EABKey   string
+	// Challenges lists the challenge types answered, comma separated
+	Challenges string
+}
+
+func (c *ACMEConfig) validate() error {
+	challenges := strings.Split(c.Challenges, ",")
+	for _, challenge := range challenges {
+		if challenge = strings.TrimSpace(challenge); challenge != http01 && challenge != tlsALPN01 {
+			return fmt.Errorf("Unknown ACME challenge '%s' (%s, %s)", challenge, http01, tlsALPN01)
+		}
+	}
+	if (c.EABKeyID == "") != (c.EABKey == "") {
+		return errors.New("External account binding needs both acme-eab-kid and acme-eab-key")
+	}
+	_, err := c.eabKey()
+	return err
+}
+
+func (c *ACMEConfig) eabKey() ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(c.EABKey, "="))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid acme-eab-key, base64url expected: %v", err)
+	}
+	return key, nil
+}
+
+func (c *ACMEConfig) challenge(typ string) bool {
+	for _, challenge := range strings.Split(c.Challenges, ",") {
+		if strings.TrimSpace(challenge) == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// manager returns the autocert manager requesting certificates for the hosts
+// the policy accepts, and caching them in cache.
+func (c *ACMEConfig) manager(cache autocert.Cache, policy autocert.HostPolicy) (*autocert.Manager, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	directory := c.Directory
+	switch directory {
+	case "":
+		directory = acme.LetsEncryptURL
+	case "staging":
+		directory = letsEncryptStagingURL
+	}
+	m := &autocert.Manager{
+		Cache:      cache,
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: policy,
+		Email:      c.Email,
+		Client:     &acme.Client{DirectoryURL: directory},
+	}
+	if c.EABKeyID != "" {
+		key, _ := c.eabKey()
+		m.ExternalAccountBinding = &acme.ExternalAccountBinding{KID: c.EABKeyID, Key: key}
+	}
+	return m, nil
+}
+
+// tlsConfig returns the config of the https server, which answers TLS-ALPN-01
+// challenges when they are enabled.
+func (c *ACMEConfig) tlsConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	config := &tls.Config{GetCertificate: getCertificate}
+	if c.challenge(tlsALPN01) {
+		config.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+	}
+	return config
+}
+
+// httpHandler answers HTTP-01 challenges when they are enabled, and hands
+// the other requests to h.
+func (c *ACMEConfig) httpHandler(m *autocert.Manager, h http.Handler) http.Handler {
+	if c.challenge(http01) {
+		return m.HTTPHandler(h)
+	}
+	return h
+}
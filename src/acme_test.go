@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeStandIn is a minimal ACME (RFC 8555) server standing in for Pebble. It
+// validates the challenges against the gateway at httpAddr and tlsAddr, and
+// issues certificates from its own CA. Requests are not checked for a valid
+// signature, except for the external account binding.
+type acmeStandIn struct {
+	*httptest.Server
+	httpAddr, tlsAddr string
+	eabKID            string
+	eabKey            []byte
+
+	mu         sync.Mutex
+	ca         *x509.Certificate
+	caKey      *ecdsa.PrivateKey
+	accounts   map[string]string
+	contacts   []string
+	orders     []*standInOrder
+	nonce      int
+	validated  []string
+	challenges []string
+}
+
+type standInOrder struct {
+	domain, account, token string
+	authz, status          string
+	cert                   []byte
+}
+
+func newACMEStandIn(t *testing.T) *acmeStandIn {
+	s := &acmeStandIn{accounts: map[string]string{}}
+	s.caKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ACME stand-in CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &s.caKey.PublicKey, s.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ca, _ = x509.ParseCertificate(der)
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// jws is a request body, protected and payload are base64url encoded JSON
+type jws struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil || len(data) == 0 {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (s *acmeStandIn) problem(w http.ResponseWriter, status int, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"type": "urn:ietf:params:acme:error:" + typ, "detail": detail})
+}
+
+func (s *acmeStandIn) reply(w http.ResponseWriter, status int, location string, v interface{}) {
+	if location != "" {
+		w.Header().Set("Location", s.URL+location)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *acmeStandIn) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nonce++
+	w.Header().Set("Replay-Nonce", strconv.Itoa(s.nonce))
+	if r.URL.Path == "/dir" {
+		s.reply(w, http.StatusOK, "", map[string]interface{}{
+			"newNonce": s.URL + "/nonce", "newAccount": s.URL + "/account", "newOrder": s.URL + "/order",
+			"revokeCert": s.URL + "/revoke", "keyChange": s.URL + "/key-change",
+			"meta": map[string]interface{}{"termsOfService": s.URL + "/terms", "externalAccountRequired": s.eabKID != ""},
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var body jws
+	var protected struct {
+		JWK json.RawMessage `json:"jwk"`
+		KID string          `json:"kid"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || decodeSegment(body.Protected, &protected) != nil {
+		s.problem(w, http.StatusBadRequest, "malformed", "not a JWS")
+		return
+	}
+	if r.URL.Path == "/account" {
+		s.newAccount(w, body, protected.JWK)
+		return
+	}
+	account := strings.TrimPrefix(protected.KID, s.URL)
+	if _, found := s.accounts[account]; !found {
+		s.problem(w, http.StatusUnauthorized, "accountDoesNotExist", protected.KID)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if r.URL.Path == "/order" {
+		var request struct {
+			Identifiers []struct{ Value string }
+		}
+		decodeSegment(body.Payload, &request)
+		order := &standInOrder{domain: request.Identifiers[0].Value, account: account, authz: "pending", status: "pending"}
+		order.token = fmt.Sprintf("token-%d", len(s.orders))
+		s.orders = append(s.orders, order)
+		s.reply(w, http.StatusCreated, fmt.Sprintf("/orders/%d", len(s.orders)-1), s.orderJSON(len(s.orders)-1))
+		return
+	}
+	if len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+	n, err := strconv.Atoi(parts[1])
+	if err != nil || n >= len(s.orders) || s.orders[n].account != account {
+		http.NotFound(w, r)
+		return
+	}
+	order := s.orders[n]
+	switch parts[0] {
+	case "orders":
+		s.reply(w, http.StatusOK, r.URL.Path, s.orderJSON(n))
+	case "authz":
+		s.reply(w, http.StatusOK, "", s.authzJSON(n))
+	case "challenges":
+		typ := parts[2]
+		s.challenges = append(s.challenges, typ)
+		if err := s.validate(order, typ); err != nil {
+			order.authz = "invalid"
+		} else if order.authz == "pending" {
+			order.authz, order.status = "valid", "ready"
+			s.validated = append(s.validated, typ)
+		}
+		s.reply(w, http.StatusOK, "", s.challengeJSON(n, typ))
+	case "finalize":
+		var request struct{ CSR string }
+		decodeSegment(body.Payload, &request)
+		der, _ := base64.RawURLEncoding.DecodeString(request.CSR)
+		if order.status != "ready" {
+			s.problem(w, http.StatusForbidden, "orderNotReady", "order is "+order.status)
+			return
+		}
+		if err := s.issue(order, der); err != nil {
+			s.problem(w, http.StatusBadRequest, "badCSR", err.Error())
+			return
+		}
+		s.reply(w, http.StatusOK, fmt.Sprintf("/orders/%d", n), s.orderJSON(n))
+	case "certificates":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(order.cert)
+		w.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.ca.Raw}))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *acmeStandIn) newAccount(w http.ResponseWriter, body jws, jwk json.RawMessage) {
+	var request struct {
+		Contact                []string `json:"contact"`
+		ExternalAccountBinding *jws     `json:"externalAccountBinding"`
+	}
+	decodeSegment(body.Payload, &request)
+	if s.eabKID != "" {
+		var eab struct {
+			KID string `json:"kid"`
+		}
+		binding := request.ExternalAccountBinding
+		if binding == nil || decodeSegment(binding.Protected, &eab) != nil || eab.KID != s.eabKID {
+			s.problem(w, http.StatusUnauthorized, "externalAccountRequired", "no external account binding")
+			return
+		}
+		mac := hmac.New(sha256.New, s.eabKey)
+		mac.Write([]byte(binding.Protected + "." + binding.Payload))
+		if base64.RawURLEncoding.EncodeToString(mac.Sum(nil)) != binding.Signature {
+			s.problem(w, http.StatusUnauthorized, "unauthorized", "invalid external account binding")
+			return
+		}
+	}
+	var key struct{ Crv, X, Y string }
+	json.Unmarshal(jwk, &key)
+	thumbprint := sha256.Sum256([]byte(fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, key.Crv, key.X, key.Y)))
+	location := fmt.Sprintf("/accounts/%d", len(s.accounts))
+	s.accounts[location] = base64.RawURLEncoding.EncodeToString(thumbprint[:])
+	s.contacts = append(s.contacts, request.Contact...)
+	s.reply(w, http.StatusCreated, location, map[string]interface{}{"status": "valid", "contact": request.Contact})
+}
+
+func (s *acmeStandIn) orderJSON(n int) map[string]interface{} {
+	order := s.orders[n]
+	v := map[string]interface{}{
+		"status":         order.status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": order.domain}},
+		"authorizations": []string{fmt.Sprintf("%s/authz/%d", s.URL, n)},
+		"finalize":       fmt.Sprintf("%s/finalize/%d", s.URL, n),
+	}
+	if order.cert != nil {
+		v["certificate"] = fmt.Sprintf("%s/certificates/%d", s.URL, n)
+	}
+	return v
+}
+
+func (s *acmeStandIn) challengeJSON(n int, typ string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":   typ,
+		"url":    fmt.Sprintf("%s/challenges/%d/%s", s.URL, n, typ),
+		"token":  s.orders[n].token,
+		"status": s.orders[n].authz,
+	}
+}
+
+func (s *acmeStandIn) authzJSON(n int) map[string]interface{} {
+	return map[string]interface{}{
+		"status":     s.orders[n].authz,
+		"identifier": map[string]string{"type": "dns", "value": s.orders[n].domain},
+		"challenges": []interface{}{s.challengeJSON(n, tlsALPN01), s.challengeJSON(n, http01)},
+	}
+}
+
+// validate checks the gateway answers the challenge with the key
+// authorization of the order
+func (s *acmeStandIn) validate(order *standInOrder, typ string) error {
+	keyAuth := order.token + "." + s.accounts[order.account]
+	switch typ {
+	case http01:
+		r, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/.well-known/acme-challenge/"+order.token, nil)
+		r.Host = order.domain
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		if string(body) != keyAuth {
+			return fmt.Errorf("unexpected key authorization %q", body)
+		}
+		return nil
+	case tlsALPN01:
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", s.tlsAddr, &tls.Config{
+			ServerName: order.domain, NextProtos: []string{"acme-tls/1"}, InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		digest := sha256.Sum256([]byte(keyAuth))
+		expected, _ := asn1.Marshal(digest[:])
+		for _, ext := range conn.ConnectionState().PeerCertificates[0].Extensions {
+			if ext.Id.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}) && bytes.Equal(ext.Value, expected) {
+				return nil
+			}
+		}
+		return errors.New("no acmeIdentifier matching the key authorization")
+	}
+	return fmt.Errorf("unknown challenge %s", typ)
+}
+
+func (s *acmeStandIn) issue(order *standInOrder, der []byte) error {
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(len(s.orders) + 1)),
+		Subject:      pkix.Name{CommonName: order.domain},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, s.ca, csr.PublicKey, s.caKey)
+	if err != nil {
+		return err
+	}
+	order.cert, order.status = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), "valid"
+	return nil
+}
+
+func TestACMEIssuance(t *testing.T) {
+	for _, challenge := range []string{http01, tlsALPN01} {
+		t.Run(challenge, func(t *testing.T) {
+			standIn := newACMEStandIn(t)
+			defer standIn.Close()
+			standIn.eabKID, standIn.eabKey = "kid-1", []byte("external account secret")
+
+			dir, err := ioutil.TempDir("", "certs")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			config := &ACMEConfig{
+				Directory:  standIn.URL + "/dir",
+				Email:      "ops@example.test",
+				EABKeyID:   "kid-1",
+				EABKey:     base64.RawURLEncoding.EncodeToString(standIn.eabKey),
+				Challenges: challenge,
+			}
+			cache := autocert.DirCache(dir)
+			m, err := config.manager(cache, autocert.HostWhitelist("shop.example.test"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			httpServer := httptest.NewServer(config.httpHandler(m, http.NotFoundHandler()))
+			defer httpServer.Close()
+			tlsServer := httptest.NewUnstartedServer(http.NotFoundHandler())
+			tlsServer.TLS = config.tlsConfig(m.GetCertificate)
+			tlsServer.StartTLS()
+			defer tlsServer.Close()
+			standIn.httpAddr, standIn.tlsAddr = httpServer.Listener.Addr().String(), tlsServer.Listener.Addr().String()
+
+			roots := x509.NewCertPool()
+			roots.AddCert(standIn.ca)
+			conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", standIn.tlsAddr, &tls.Config{ServerName: "shop.example.test", RootCAs: roots})
+			if err != nil {
+				t.Fatalf("Expected a certificate issued by the ACME server: %v (challenges tried %v)", err, standIn.challenges)
+			}
+			conn.Close()
+
+			standIn.mu.Lock()
+			defer standIn.mu.Unlock()
+			if len(standIn.validated) != 1 || standIn.validated[0] != challenge {
+				t.Errorf("Expected the %s challenge to be validated, got %v", challenge, standIn.validated)
+			}
+			if len(standIn.contacts) != 1 || standIn.contacts[0] != "mailto:ops@example.test" {
+				t.Errorf("Expected the account contact, got %v", standIn.contacts)
+			}
+			statuses := certificateStatuses(context.Background(), cache, []string{"shop.example.test"}, time.Now())
+			if statuses[0].Status != "valid" || statuses[0].Issuer != "ACME stand-in CA" {
+				t.Errorf("Expected the certificate in the cache, got %+v", statuses[0])
+			}
+		})
+	}
+}
+
+func TestACMEConfigValidate(t *testing.T) {
+	for _, config := range []ACMEConfig{
+		{Challenges: "dns-01"},
+		{Challenges: ""},
+		{Challenges: http01, EABKeyID: "kid-1"},
+		{Challenges: http01, EABKeyID: "kid-1", EABKey: "not base64!"},
+	} {
+		if err := config.validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+	if err := (&ACMEConfig{Challenges: "http-01, tls-alpn-01", EABKeyID: "kid-1", EABKey: "c2VjcmV0"}).validate(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/acme/autocert"
+	"gopkg.in/yaml.v2"
+
+	"gateway/resolver"
+)
+
+// Admin serves what the gateway currently routes, and lets it be changed at
+// runtime, on its own port. Every request must carry the token as a bearer
+// token.
+type Admin struct {
+	Token  string
+	Proxy  *ProxyServer
+	Health *HealthChecker
+	// Certificates reports the TLS certificates of the served hosts, it is
+	// nil when https is disabled
+	Certificates func() []CertificateStatus
+}
+
+// RouteStatus is a route as currently resolved, with the endpoints serving it
+type RouteStatus struct {
+	Route     *resolver.Route `json:"route,omitempty"`
+	Stack     string          `json:"stack,omitempty"`
+	Endpoints []string        `json:"endpoints"`
+	// Healthy are the endpoints passing their health check
+	Healthy []string `json:"healthy"`
+}
+
+// CertificateStatus describes the certificate cached for a host
+type CertificateStatus struct {
+	Host string `json:"host"`
+	// Status is valid, expired, missing or invalid
+	Status string `json:"status"`
+	// Source is static for the certificates brought along, acme for the ones
+	// requested from Let's Encrypt and local-ca for the ones of the local CA
+	Source    string    `json:"source"`
+	Issuer    string    `json:"issuer,omitempty"`
+	NotBefore time.Time `json:"notBefore,omitempty"`
+	NotAfter  time.Time `json:"notAfter,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// ListenAndServe serves the admin API on the given port.
+func (a *Admin) ListenAndServe(port int64) error {
+	fmt.Println("gatway admin API listening on port", port)
+	return http.ListenAndServe(fmt.Sprintf(":%d", port), a.Handler())
+}
+
+// Handler returns the admin API routes, behind the token check.
+func (a *Admin) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/resolver", a.get(a.handleResolver))
+	mux.HandleFunc("/api/routes", a.get(a.handleRoutes))
+	mux.HandleFunc("/api/port-mappings", a.get(a.handlePortMappings))
+	mux.HandleFunc("/api/tls", a.get(a.handleTLS))
+	mux.HandleFunc("/api/overrides", a.handleOverrides)
+	mux.HandleFunc("/api/overrides/", a.handleOverride)
+	mux.HandleFunc("/api/resync", a.handleResync)
+	mux.Handle("/metrics", promhttp.Handler())
+	if manager := a.Proxy.DeploymentManager(); manager != nil {
+		mux.HandleFunc("/api/deployments", deploymentsHandler(manager))
+		mux.HandleFunc("/api/deployments/", deploymentsHandler(manager))
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gateway"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (a *Admin) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return a.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1
+}
+
+// get only lets GET and HEAD requests through to h
+func (a *Admin) get(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (a *Admin) handleResolver(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"name": a.Proxy.Resolver().GetName()})
+}
+
+func (a *Admin) handleRoutes(w http.ResponseWriter, r *http.Request) {
+	statuses := []RouteStatus{}
+	for _, destination := range a.Proxy.Destinations() {
+		statuses = append(statuses, RouteStatus{
+			Route:     destination.Route,
+			Stack:     destination.Stack,
+			Endpoints: destination.Endpoints,
+			Healthy:   a.Health.Healthy(destination).Endpoints,
+		})
+	}
+	sort.SliceStable(statuses, func(i, j int) bool {
+		return statuses[i].Route.String() < statuses[j].Route.String()
+	})
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (a *Admin) handlePortMappings(w http.ResponseWriter, r *http.Request) {
+	mapper, ok := a.Proxy.Resolver().(resolver.PortMapper)
+	if !ok {
+		http.Error(w, fmt.Sprintf("The %s resolver does not map ports", a.Proxy.Resolver().GetName()), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, mapper.PortMappings())
+}
+
+func (a *Admin) handleTLS(w http.ResponseWriter, r *http.Request) {
+	if a.Certificates == nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"enabled": false})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"enabled": true, "certificates": a.Certificates()})
+}
+
+// handleOverrides lists the route overrides, and adds one when a route is
+// posted. The body is YAML (or JSON) like the routes of the config file:
+// {"route": {"host": ..., "destination": ...}, "ttl": "10m"}
+func (a *Admin) handleOverrides(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+		writeJSON(w, http.StatusOK, a.Proxy.Overrides())
+	case "POST":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var request struct {
+			Route resolver.Route `yaml:"route"`
+			TTL   time.Duration  `yaml:"ttl"`
+		}
+		if err := yaml.UnmarshalStrict(body, &request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkRoute(&request.Route); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid route: %v", err), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, a.Proxy.Override(request.Route, request.TTL))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *Admin) handleOverride(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/overrides/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.Proxy.RemoveOverride(id) {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) handleResync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resyncer, ok := a.Proxy.Resolver().(resolver.Resyncer)
+	if !ok {
+		http.Error(w, fmt.Sprintf("The %s resolver has nothing to resync", a.Proxy.Resolver().GetName()), http.StatusNotFound)
+		return
+	}
+	resyncer.Resync()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// certificateStatuses looks the certificates of the hosts up in the autocert
+// cache, which keeps the private key and the certificate chain as PEM.
+func certificateStatuses(ctx context.Context, cache autocert.Cache, hosts []string, now time.Time) []CertificateStatus {
+	statuses := []CertificateStatus{}
+	for _, host := range hosts {
+		status := CertificateStatus{Host: host, Source: "acme"}
+		data, err := cache.Get(ctx, host)
+		if err == autocert.ErrCacheMiss {
+			status.Status = "missing"
+			statuses = append(statuses, status)
+			continue
+		}
+		var cert *x509.Certificate
+		for err == nil {
+			var block *pem.Block
+			if block, data = pem.Decode(data); block == nil {
+				err = fmt.Errorf("no certificate found")
+			} else if block.Type == "CERTIFICATE" {
+				cert, err = x509.ParseCertificate(block.Bytes)
+				break
+			}
+		}
+		switch {
+		case err != nil:
+			status.Status, status.Error = "invalid", err.Error()
+		case now.After(cert.NotAfter):
+			status.Status = "expired"
+		default:
+			status.Status = "valid"
+		}
+		if cert != nil {
+			status.Issuer, status.NotBefore, status.NotAfter = cert.Issuer.CommonName, cert.NotBefore, cert.NotAfter
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
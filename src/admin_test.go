@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+
+	"gateway/resolver"
+)
+
+func TestAdminOverrides(t *testing.T) {
+	subnet := &resolver.Subnet{}
+	routes := []resolver.Route{{Name: "shop", Host: "shop", Destination: "shop-v1", Port: 80}}
+	subnet.SetRoutes(routes)
+	ps := &ProxyServer{destinationResolver: subnet, routes: routes}
+	admin := (&Admin{Token: "secret", Proxy: ps}).Handler()
+
+	request := func(method, url, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w
+	}
+	target := func() string {
+		destination, _ := subnet.Resolve(httptest.NewRequest("GET", "http://shop/", nil))
+		return destination.HostPort
+	}
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/api/routes", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected requests without the token to be rejected, got %d", w.Code)
+	}
+
+	w = request("POST", "/api/overrides", `{"route": {"host": "shop", "destination": "shop-v2"}}`)
+	if w.Code != http.StatusCreated || target() != "shop-v2:80" {
+		t.Fatalf("Expected the override to replace the configured route, got %d %s to %s", w.Code, w.Body, target())
+	}
+	var override RouteOverride
+	json.Unmarshal(w.Body.Bytes(), &override)
+
+	// reloading the config keeps the override on top
+	ps.SetRoutes(routes)
+	if target() != "shop-v2:80" {
+		t.Errorf("Expected the override to survive a reload, got %s", target())
+	}
+	if w := request("POST", "/api/overrides", `{"route": {"destination": "shop-v3"}}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected routes without host to be rejected, got %d", w.Code)
+	}
+	if w := request("DELETE", "/api/overrides/"+strconv.Itoa(override.ID), ""); w.Code != http.StatusNoContent || target() != "shop-v1:80" {
+		t.Errorf("Expected the configured route back once the override is removed, got %d to %s", w.Code, target())
+	}
+
+	request("POST", "/api/overrides", `{"route": {"host": "shop", "destination": "shop-v2"}, "ttl": "10ms"}`)
+	waitFor(t, "the override to expire", func() bool { return target() == "shop-v1:80" })
+	if overrides := ps.Overrides(); len(overrides) != 0 {
+		t.Errorf("Expected no override left, got %v", overrides)
+	}
+
+	if w := request("POST", "/api/resync", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected the subnet resolver to have nothing to resync, got %d", w.Code)
+	}
+}
+
+func TestCertificateStatuses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := autocert.DirCache(dir)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	notAfter := time.Now().Add(24 * time.Hour)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "shop.example.test"},
+		Issuer:       pkix.Name{CommonName: "shop.example.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	data := append(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	cache.Put(context.Background(), "shop.example.test", data)
+	cache.Put(context.Background(), "broken.example.test", []byte("garbage"))
+
+	hosts := []string{"shop.example.test", "broken.example.test", "new.example.test"}
+	statuses := certificateStatuses(context.Background(), cache, hosts, time.Now())
+	if statuses[0].Status != "valid" || statuses[0].Issuer != "shop.example.test" || !statuses[0].NotAfter.Equal(notAfter.Truncate(time.Second)) {
+		t.Errorf("Expected a valid certificate, got %+v", statuses[0])
+	}
+	if statuses[1].Status != "invalid" || statuses[2].Status != "missing" {
+		t.Errorf("Expected an invalid and a missing certificate, got %+v", statuses[1:])
+	}
+	if expired := certificateStatuses(context.Background(), cache, hosts[:1], notAfter.Add(time.Minute)); expired[0].Status != "expired" {
+		t.Errorf("Expected the certificate to expire, got %+v", expired[0])
+	}
+}
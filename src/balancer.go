@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+
+	"gateway/resolver"
+)
+
+// Load balancing policies, set with the load-balancing flag or per route.
+const (
+	roundRobin       = "round-robin"
+	leastConnections = "least-connections"
+	randomPick       = "random"
+	consistentHash   = "hash"
+)
+
+func validPolicy(policy string) error {
+	if policy == "" {
+		return nil
+	}
+	for _, valid := range resolver.LoadBalancingPolicies {
+		if policy == valid {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown load balancing policy '%s' (%s)", policy, strings.Join(resolver.LoadBalancingPolicies, ", "))
+}
+
+// Balancer picks which endpoint of a destination a request is proxied to.
+type Balancer struct {
+	// Policy applies to routes that do not set their own
+	Policy string
+	// HashHeader or HashCookie name the value the hash policy hashes, so
+	// requests carrying the same value stick to the same endpoint
+	HashHeader string
+	HashCookie string
+
+	mu sync.Mutex
+	// next is the round-robin position of each route, kept across changes
+	// of its endpoints
+	next map[string]int
+	// active counts the requests in flight to each endpoint
+	active map[string]int
+}
+
+// Pick returns the endpoint to proxy the request to, and a func to call once
+// the request is done.
+func (b *Balancer) Pick(r *http.Request, destination resolver.Destination) (string, func()) {
+	endpoints := destination.Endpoints
+	if b == nil || len(endpoints) < 2 {
+		return destination.HostPort, func() {}
+	}
+	policy := b.Policy
+	if destination.Route != nil && destination.Route.LoadBalancing != "" {
+		policy = destination.Route.LoadBalancing
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.active == nil {
+		b.active = map[string]int{}
+		b.next = map[string]int{}
+	}
+
+	key := balanceKey(r, destination)
+	endpoint := ""
+	switch policy {
+	case leastConnections:
+		endpoint = b.leastConnections(key, endpoints)
+	case randomPick:
+		endpoint = endpoints[rand.Intn(len(endpoints))]
+	case consistentHash:
+		if key := b.hashKey(r); key != "" {
+			endpoint = rendezvous(key, endpoints)
+		}
+	}
+	if endpoint == "" {
+		endpoint = b.roundRobin(key, endpoints)
+	}
+
+	b.active[endpoint]++
+	return endpoint, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.active[endpoint]--; b.active[endpoint] <= 0 {
+			delete(b.active, endpoint)
+		}
+	}
+}
+
+// balanceKey identifies the route the request is balanced for, or its host
+// when the resolver fell back to the host name. Endpoints come and go with
+// scaling and health checks, the route stays.
+func balanceKey(r *http.Request, destination resolver.Destination) string {
+	if destination.Route != nil {
+		return destination.Route.String()
+	}
+	return strings.Split(r.Host, ":")[0]
+}
+
+func (b *Balancer) roundRobin(key string, endpoints []string) string {
+	n := b.next[key] % len(endpoints)
+	b.next[key] = n + 1
+	return endpoints[n]
+}
+
+// leastConnections picks the endpoint with the fewest requests in flight,
+// taking turns between endpoints that are equally busy.
+func (b *Balancer) leastConnections(key string, endpoints []string) string {
+	start := b.next[key]
+	b.next[key] = (start + 1) % len(endpoints)
+
+	endpoint := ""
+	for i := range endpoints {
+		candidate := endpoints[(start+i)%len(endpoints)]
+		if endpoint == "" || b.active[candidate] < b.active[endpoint] {
+			endpoint = candidate
+		}
+	}
+	return endpoint
+}
+
+// hashKey returns the value the hash policy balances on, empty when the
+// request does not carry it.
+func (b *Balancer) hashKey(r *http.Request) string {
+	if b.HashHeader != "" {
+		if value := r.Header.Get(b.HashHeader); value != "" {
+			return value
+		}
+	}
+	if b.HashCookie != "" {
+		if cookie, err := r.Cookie(b.HashCookie); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// rendezvous hashes the key with each endpoint and picks the highest score.
+// When an endpoint goes away, only the keys it served move elsewhere.
+func rendezvous(key string, endpoints []string) string {
+	endpoint, best := "", uint64(0)
+	for _, candidate := range endpoints {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(candidate))
+		if score := h.Sum64(); endpoint == "" || score > best {
+			endpoint, best = candidate, score
+		}
+	}
+	return endpoint
+}
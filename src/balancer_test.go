@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gateway/resolver"
+)
+
+func testDestination(endpoints ...string) resolver.Destination {
+	return resolver.Destination{Route: &resolver.Route{Host: "web"}, HostPort: endpoints[0], Endpoints: endpoints}
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b := &Balancer{Policy: roundRobin}
+	destination := testDestination("a:80", "b:80", "c:80")
+	r := httptest.NewRequest("GET", "http://web/", nil)
+
+	picked := []string{}
+	for i := 0; i < 4; i++ {
+		endpoint, done := b.Pick(r, destination)
+		done()
+		picked = append(picked, endpoint)
+	}
+	if picked[0] != "a:80" || picked[1] != "b:80" || picked[2] != "c:80" || picked[3] != "a:80" {
+		t.Errorf("Endpoints should take turns, got: %v", picked)
+	}
+}
+
+func TestBalancerEndpointChanges(t *testing.T) {
+	b := &Balancer{Policy: roundRobin}
+	r := httptest.NewRequest("GET", "http://web/", nil)
+	for i := 0; i < 10; i++ {
+		_, done := b.Pick(r, testDestination("a:80", fmt.Sprintf("replica-%d:80", i)))
+		done()
+	}
+	_, done := b.Pick(httptest.NewRequest("GET", "http://other/", nil), resolver.Destination{HostPort: "x:80", Endpoints: []string{"x:80", "y:80"}})
+	done()
+	if len(b.next) != 2 {
+		t.Errorf("Expected one round-robin position per route, whatever its endpoints, got %v", b.next)
+	}
+}
+
+func TestBalancerLeastConnections(t *testing.T) {
+	b := &Balancer{Policy: leastConnections}
+	destination := testDestination("a:80", "b:80")
+	r := httptest.NewRequest("GET", "http://web/", nil)
+
+	busy, done := b.Pick(r, destination)
+	for i := 0; i < 3; i++ {
+		endpoint, next := b.Pick(r, destination)
+		next()
+		if endpoint == busy {
+			t.Errorf("Requests should go to the idle endpoint while %s is busy", busy)
+		}
+	}
+	done()
+	if len(b.active) != 0 {
+		t.Errorf("Finished requests should no longer count, got: %v", b.active)
+	}
+}
+
+func TestBalancerHash(t *testing.T) {
+	b := &Balancer{Policy: roundRobin, HashHeader: "X-User", HashCookie: "session"}
+	destination := testDestination("a:80", "b:80", "c:80")
+	destination.Route.LoadBalancing = consistentHash
+
+	request := func(user, session string) *http.Request {
+		r := httptest.NewRequest("GET", "http://web/", nil)
+		if user != "" {
+			r.Header.Set("X-User", user)
+		}
+		if session != "" {
+			r.AddCookie(&http.Cookie{Name: "session", Value: session})
+		}
+		return r
+	}
+	pick := func(r *http.Request, destination resolver.Destination) string {
+		endpoint, done := b.Pick(r, destination)
+		done()
+		return endpoint
+	}
+
+	first := pick(request("alice", ""), destination)
+	for i := 0; i < 5; i++ {
+		if endpoint := pick(request("alice", ""), destination); endpoint != first {
+			t.Fatalf("Requests of the same user should stick to %s, got: %s", first, endpoint)
+		}
+	}
+	if pick(request("", "s1"), destination) != pick(request("", "s1"), destination) {
+		t.Errorf("Requests with the same cookie should stick to an endpoint")
+	}
+
+	// removing another endpoint leaves the user where it was
+	others := []string{}
+	for _, endpoint := range destination.Endpoints {
+		if endpoint != first {
+			others = append(others, endpoint)
+		}
+	}
+	shrunk := testDestination(first, others[0])
+	shrunk.Route.LoadBalancing = consistentHash
+	if endpoint := pick(request("alice", ""), shrunk); endpoint != first {
+		t.Errorf("Removing an endpoint should not move users of the others, got: %s", endpoint)
+	}
+}
+
+func TestBalancerSingleEndpoint(t *testing.T) {
+	var b *Balancer
+	endpoint, done := b.Pick(httptest.NewRequest("GET", "http://web/", nil), testDestination("a:80"))
+	done()
+	if endpoint != "a:80" {
+		t.Errorf("Destinations should be proxied to without a balancer, got: %s", endpoint)
+	}
+}
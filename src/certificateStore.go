@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CertificatePair is a certificate chain and its private key, both PEM files.
+// Key may be left out when the certificate file holds the key as well.
+type CertificatePair struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+// parseCertificatePairs reads the cert:key pairs of the tls-certificates flag,
+// separated by commas.
+func parseCertificatePairs(value string) []CertificatePair {
+	pairs := []CertificatePair{}
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		parts := strings.SplitN(field, ":", 2)
+		pair := CertificatePair{Cert: parts[0]}
+		if len(parts) == 2 {
+			pair.Key = parts[1]
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs
+}
+
+// CertificateStore serves certificates brought along instead of requested
+// from Let's Encrypt, picked by the server name the client asks for. They
+// are read from Dir, where every .crt or .pem file goes with the .key file of
+// the same name, and from Pairs. A certificate serves the DNS names it was
+// issued for, wildcards included.
+type CertificateStore struct {
+	Dir   string
+	Pairs []CertificatePair
+
+	mu           sync.RWMutex
+	certificates map[string]*tls.Certificate
+}
+
+// Load reads the certificates again. On error the ones loaded before are kept.
+func (s *CertificateStore) Load() error {
+	pairs := append([]CertificatePair{}, s.Pairs...)
+	if s.Dir != "" {
+		found, err := certificatePairsIn(s.Dir)
+		if err != nil {
+			return err
+		}
+		pairs = append(pairs, found...)
+	}
+
+	certificates := map[string]*tls.Certificate{}
+	for _, pair := range pairs {
+		key := pair.Key
+		if key == "" {
+			key = pair.Cert
+		}
+		cert, err := tls.LoadX509KeyPair(pair.Cert, key)
+		if err != nil {
+			return fmt.Errorf("Unable to load certificate %s: %v", pair.Cert, err)
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("Unable to parse certificate %s: %v", pair.Cert, err)
+		}
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("Certificate %s names no host", pair.Cert)
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			// the certificate expiring last wins when several cover a name
+			if current, found := certificates[name]; !found || cert.Leaf.NotAfter.After(current.Leaf.NotAfter) {
+				certificates[name] = &cert
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.certificates = certificates
+	s.mu.Unlock()
+	return nil
+}
+
+// certificatePairsIn pairs the certificate files of dir with their key
+func certificatePairsIn(dir string) ([]CertificatePair, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	pairs := []CertificatePair{}
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		if file.IsDir() || (ext != ".crt" && ext != ".pem") {
+			continue
+		}
+		pair := CertificatePair{Cert: filepath.Join(dir, file.Name())}
+		key := strings.TrimSuffix(pair.Cert, ext) + ".key"
+		if _, err := os.Stat(key); err == nil {
+			pair.Key = key
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs, nil
+}
+
+// Lookup returns the certificate for the server name: the one issued for the
+// name itself, else the wildcard certificate of its parent domain.
+func (s *CertificateStore) Lookup(serverName string) *tls.Certificate {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if cert, found := s.certificates[name]; found {
+		return cert
+	}
+	if dot := strings.Index(name, "."); dot > 0 {
+		return s.certificates["*"+name[dot:]]
+	}
+	return nil
+}
+
+// Covers tells whether a certificate of the store serves the host
+func (s *CertificateStore) Covers(host string) bool {
+	return s.Lookup(host) != nil
+}
+
+// GetCertificate returns the tls.Config callback serving the certificates of
+// the store, and handing the hosts they do not cover to fallback (autocert).
+// Without fallback those get the error.
+func (s *CertificateStore) GetCertificate(fallback func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if cert := s.Lookup(hello.ServerName); cert != nil {
+			return cert, nil
+		}
+		if fallback != nil {
+			return fallback(hello)
+		}
+		return nil, errors.New("No certificate for host(" + hello.ServerName + ")")
+	}
+}
+
+// Statuses reports the certificates of the store, by the names they serve.
+func (s *CertificateStore) Statuses(now time.Time) []CertificateStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	statuses := []CertificateStatus{}
+	for name, cert := range s.certificates {
+		status := CertificateStatus{
+			Host:      name,
+			Status:    "valid",
+			Source:    "static",
+			Issuer:    cert.Leaf.Issuer.CommonName,
+			NotBefore: cert.Leaf.NotBefore,
+			NotAfter:  cert.Leaf.NotAfter,
+		}
+		if now.After(cert.Leaf.NotAfter) {
+			status.Status = "expired"
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Host < statuses[j].Host })
+	return statuses
+}
+
+// Watch loads the certificates again whenever one of their files changes.
+// Files are polled, like the config file, as inotify misses changes to bind
+// mounted files.
+func (s *CertificateStore) Watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	seen := s.fingerprint()
+	for range time.NewTicker(interval).C {
+		current := s.fingerprint()
+		if current == seen {
+			continue
+		}
+		seen = current
+		if err := s.Load(); err != nil {
+			log.Printf("Keeping current certificates: %v", err)
+			continue
+		}
+		log.Println("Reloaded certificates")
+	}
+}
+
+// fingerprint sums up the names, sizes and modification times of the files
+// certificates are read from
+func (s *CertificateStore) fingerprint() string {
+	paths := []string{}
+	for _, pair := range s.Pairs {
+		paths = append(paths, pair.Cert, pair.Key)
+	}
+	if s.Dir != "" {
+		if files, err := ioutil.ReadDir(s.Dir); err == nil {
+			for _, file := range files {
+				paths = append(paths, filepath.Join(s.Dir, file.Name()))
+			}
+		}
+	}
+	var b strings.Builder
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			fmt.Fprintf(&b, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self signed certificate for the names to
+// dir/file.crt and its key to dir/file.key
+func writeCertificate(t *testing.T, dir, file string, notAfter time.Time, names ...string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(filepath.Join(dir, file+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(filepath.Join(dir, file+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+}
+
+func TestCertificateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	expires := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	writeCertificate(t, dir, "wildcard", expires, "*.local.test")
+	writeCertificate(t, dir, "api", expires, "api.local.test")
+
+	store := &CertificateStore{Dir: dir}
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	subject := func(name string) string {
+		if cert := store.Lookup(name); cert != nil {
+			return cert.Leaf.Subject.CommonName
+		}
+		return ""
+	}
+	if subject("api.local.test") != "api.local.test" || subject("Shop.Local.Test") != "*.local.test" {
+		t.Errorf("Expected the exact certificate to win over the wildcard, got %s and %s", subject("api.local.test"), subject("shop.local.test"))
+	}
+	if subject("a.shop.local.test") != "" || subject("local.test") != "" {
+		t.Error("Expected the wildcard to cover a single label only")
+	}
+
+	fallback := func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return &tls.Certificate{}, nil
+	}
+	getCertificate := store.GetCertificate(fallback)
+	if cert, _ := getCertificate(&tls.ClientHelloInfo{ServerName: "shop.local.test"}); cert.Leaf == nil {
+		t.Error("Expected the wildcard certificate for shop.local.test")
+	}
+	if cert, _ := getCertificate(&tls.ClientHelloInfo{ServerName: "shop.example.com"}); cert.Leaf != nil {
+		t.Error("Expected hosts without a certificate to fall back to autocert")
+	}
+	if _, err := store.GetCertificate(nil)(&tls.ClientHelloInfo{ServerName: "shop.example.com"}); err == nil {
+		t.Error("Expected an error without certificate nor fallback")
+	}
+
+	statuses := store.Statuses(time.Now())
+	if len(statuses) != 2 || statuses[0].Host != "*.local.test" || statuses[0].Source != "static" || !statuses[0].NotAfter.Equal(expires) {
+		t.Errorf("Expected the statuses of both certificates, got %+v", statuses)
+	}
+
+	// a changed file is noticed, and a broken one keeps the current certificates
+	seen := store.fingerprint()
+	writeCertificate(t, dir, "api", expires, "api.local.test", "admin.local.test")
+	if store.fingerprint() == seen {
+		t.Error("Expected the fingerprint to change with the files")
+	}
+	if err := store.Load(); err != nil || subject("admin.local.test") != "api.local.test" {
+		t.Errorf("Expected the reloaded certificate to cover admin.local.test (%v)", err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "api.key"), []byte("garbage"), 0600)
+	if err := store.Load(); err == nil || subject("admin.local.test") == "" {
+		t.Errorf("Expected a broken key to fail the reload and keep the certificates (%v)", err)
+	}
+}
+
+func TestParseCertificatePairs(t *testing.T) {
+	pairs := parseCertificatePairs("a.crt:a.key, both.pem,")
+	if len(pairs) != 2 || pairs[0] != (CertificatePair{"a.crt", "a.key"}) || pairs[1] != (CertificatePair{Cert: "both.pem"}) {
+		t.Errorf("Unexpected pairs %+v", pairs)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"gateway/resolver"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// breaker follows the outcome of the requests proxied to one endpoint.
+type breaker struct {
+	state    breakerState
+	openedAt time.Time
+	// probing is set while the single request let through a half-open
+	// breaker is in flight
+	probing bool
+	// failures counts the requests failed in a row
+	failures int
+	// outcomes is a ring of the last requests, true for the failed ones
+	outcomes []bool
+	next     int
+	trips    int
+}
+
+func (b *breaker) record(failed bool, window int) {
+	if failed {
+		b.failures++
+	} else {
+		b.failures = 0
+	}
+	if window <= 0 {
+		return
+	}
+	if len(b.outcomes) < window {
+		b.outcomes = append(b.outcomes, failed)
+		return
+	}
+	b.outcomes[b.next] = failed
+	b.next = (b.next + 1) % window
+}
+
+func (b *breaker) errorRate() float64 {
+	if len(b.outcomes) == 0 {
+		return 0
+	}
+	failed := 0
+	for _, outcome := range b.outcomes {
+		if outcome {
+			failed++
+		}
+	}
+	return float64(failed) / float64(len(b.outcomes))
+}
+
+// CircuitBreakers stop proxying to endpoints that keep failing. A breaker
+// trips after Failures requests failed in a row, or when ErrorRate of the
+// last Window requests failed. Once OpenDuration went by, a single request
+// probes the endpoint, and closes the breaker again when it succeeds.
+type CircuitBreakers struct {
+	Failures     int
+	ErrorRate    float64
+	Window       int
+	OpenDuration time.Duration
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+	// now is replaced by the tests
+	now func() time.Time
+}
+
+func (c *CircuitBreakers) enabled() bool {
+	return c != nil && (c.Failures > 0 || c.ErrorRate > 0)
+}
+
+func (c *CircuitBreakers) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+func (c *CircuitBreakers) breaker(endpoint string) *breaker {
+	if c.breakers == nil {
+		c.breakers = map[string]*breaker{}
+	}
+	b, found := c.breakers[endpoint]
+	if !found {
+		b = &breaker{}
+		c.breakers[endpoint] = b
+	}
+	return b
+}
+
+func (c *CircuitBreakers) transition(endpoint string, b *breaker, state breakerState) {
+	log.Printf("Circuit breaker for %s is %s (was %s)", endpoint, state, b.state)
+	b.state = state
+	b.probing = false
+	breakerStates.WithLabelValues(endpoint).Set(float64(state))
+	switch state {
+	case breakerOpen:
+		b.openedAt = c.clock()
+		b.trips++
+		breakerTripsTotal.WithLabelValues(endpoint).Inc()
+	case breakerClosed:
+		b.failures, b.outcomes, b.next = 0, nil, 0
+	}
+}
+
+// blocked tells whether requests to the endpoint are turned away right now
+func (c *CircuitBreakers) blocked(b *breaker) bool {
+	switch b.state {
+	case breakerOpen:
+		return c.clock().Sub(b.openedAt) < c.OpenDuration
+	case breakerHalfOpen:
+		return b.probing
+	}
+	return false
+}
+
+// Allow tells whether a request may be proxied to the endpoint. The first
+// request allowed once the breaker has been open long enough is the probe.
+func (c *CircuitBreakers) Allow(endpoint string) bool {
+	if !c.enabled() {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.breaker(endpoint)
+	if c.blocked(b) {
+		return false
+	}
+	if b.state == breakerOpen {
+		c.transition(endpoint, b, breakerHalfOpen)
+	}
+	if b.state == breakerHalfOpen {
+		b.probing = true
+	}
+	return true
+}
+
+// Report records the outcome of a request proxied to the endpoint.
+func (c *CircuitBreakers) Report(endpoint string, failed bool) {
+	if !c.enabled() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.breaker(endpoint)
+	switch b.state {
+	case breakerHalfOpen:
+		if failed {
+			c.transition(endpoint, b, breakerOpen)
+		} else {
+			c.transition(endpoint, b, breakerClosed)
+		}
+	case breakerClosed:
+		b.record(failed, c.Window)
+		if c.Failures > 0 && b.failures >= c.Failures {
+			c.transition(endpoint, b, breakerOpen)
+		} else if c.ErrorRate > 0 && len(b.outcomes) >= c.Window && b.errorRate() >= c.ErrorRate {
+			c.transition(endpoint, b, breakerOpen)
+		}
+	}
+}
+
+// Available returns the destination without the endpoints whose breaker is
+// open.
+func (c *CircuitBreakers) Available(destination resolver.Destination) resolver.Destination {
+	if !c.enabled() {
+		return destination
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	endpoints := []string{}
+	for _, endpoint := range destination.Endpoints {
+		if b, found := c.breakers[endpoint]; found && c.blocked(b) {
+			continue
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	destination.Endpoints = endpoints
+	destination.HostPort = ""
+	if len(endpoints) > 0 {
+		destination.HostPort = endpoints[0]
+	}
+	return destination
+}
+
+// BreakerStatus is the state of the breaker of an endpoint.
+type BreakerStatus struct {
+	Endpoint            string    `json:"endpoint"`
+	State               string    `json:"state"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	ErrorRate           float64   `json:"errorRate"`
+	Trips               int       `json:"trips"`
+	OpenedAt            time.Time `json:"openedAt,omitempty"`
+}
+
+// Statuses returns the state of the breaker of every endpoint proxied to.
+func (c *CircuitBreakers) Statuses() []BreakerStatus {
+	statuses := []BreakerStatus{}
+	if c == nil {
+		return statuses
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for endpoint, b := range c.breakers {
+		statuses = append(statuses, BreakerStatus{
+			Endpoint:            endpoint,
+			State:               b.state.String(),
+			ConsecutiveFailures: b.failures,
+			ErrorRate:           b.errorRate(),
+			Trips:               b.trips,
+			OpenedAt:            b.openedAt,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Endpoint < statuses[j].Endpoint })
+	return statuses
+}
+
+func (c *CircuitBreakers) handleBreakers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, c.Statuses())
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"gateway/resolver"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestCircuitBreakerConsecutiveFailures(t *testing.T) {
+	now := time.Now()
+	c := &CircuitBreakers{Failures: 3, OpenDuration: time.Minute, now: func() time.Time { return now }}
+
+	for i := 0; i < 2; i++ {
+		c.Report("a:80", true)
+	}
+	c.Report("a:80", false)
+	for i := 0; i < 2; i++ {
+		c.Report("a:80", true)
+	}
+	if !c.Allow("a:80") {
+		t.Fatalf("A success in between should reset the failures in a row")
+	}
+	c.Report("a:80", true)
+	if c.Allow("a:80") {
+		t.Fatalf("Expected the breaker to open after 3 failures in a row")
+	}
+
+	now = now.Add(time.Minute)
+	if !c.Allow("a:80") {
+		t.Fatalf("Expected a probe once the breaker was open long enough")
+	}
+	if c.Allow("a:80") {
+		t.Errorf("Only a single probe should be let through a half-open breaker")
+	}
+	c.Report("a:80", true)
+	if c.Allow("a:80") || c.Statuses()[0].Trips != 2 {
+		t.Errorf("A failed probe should open the breaker again, got: %+v", c.Statuses())
+	}
+
+	now = now.Add(time.Minute)
+	c.Allow("a:80")
+	c.Report("a:80", false)
+	if status := c.Statuses()[0]; status.State != "closed" || status.ConsecutiveFailures != 0 {
+		t.Errorf("A successful probe should close the breaker, got: %+v", status)
+	}
+}
+
+func TestCircuitBreakerErrorRate(t *testing.T) {
+	c := &CircuitBreakers{ErrorRate: 0.5, Window: 4, OpenDuration: time.Minute}
+	for _, failed := range []bool{true, false, true} {
+		c.Report("a:80", failed)
+	}
+	if !c.Allow("a:80") {
+		t.Fatalf("The error rate should only count once the window is full")
+	}
+	c.Report("a:80", false)
+	if c.Allow("a:80") {
+		t.Errorf("Expected the breaker to open at a 50%% error rate, got: %+v", c.Statuses())
+	}
+
+	destination := resolver.Destination{HostPort: "a:80", Endpoints: []string{"a:80", "b:80"}}
+	if available := c.Available(destination); len(available.Endpoints) != 1 || available.HostPort != "b:80" {
+		t.Errorf("Endpoints with an open breaker should not be balanced to, got: %v", available.Endpoints)
+	}
+}
+
+func TestErrorHandlingTransportBreaker(t *testing.T) {
+	calls := 0
+	transport := errorHandlingTransport{
+		RoundTripper: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			calls++
+			return nil, errors.New("connection refused")
+		}),
+		breakers: &CircuitBreakers{Failures: 2, OpenDuration: time.Minute},
+	}
+
+	statuses := []int{}
+	for i := 0; i < 3; i++ {
+		resp, err := transport.RoundTrip(httptest.NewRequest("GET", "http://a:80/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		statuses = append(statuses, resp.StatusCode)
+	}
+	if statuses[0] != 502 || statuses[1] != 502 || statuses[2] != 503 {
+		t.Errorf("Expected 2 bad gateways then service unavailable, got: %v", statuses)
+	}
+	if calls != 2 {
+		t.Errorf("An open breaker should fail fast without contacting the backend, got %d calls", calls)
+	}
+}
+
+func TestCircuitBreakerMetrics(t *testing.T) {
+	now := time.Now()
+	c := &CircuitBreakers{Failures: 1, OpenDuration: time.Minute, now: func() time.Time { return now }}
+	endpoint := "breaker-metrics:80"
+	state := func() float64 { return testutil.ToFloat64(breakerStates.WithLabelValues(endpoint)) }
+	trips := func() float64 { return testutil.ToFloat64(breakerTripsTotal.WithLabelValues(endpoint)) }
+
+	c.Report(endpoint, true)
+	if state() != 1 || trips() != 1 {
+		t.Errorf("Expected an open breaker tripped once, got state %v and %v trips", state(), trips())
+	}
+	now = now.Add(time.Minute)
+	c.Allow(endpoint)
+	if state() != 2 {
+		t.Errorf("Expected a half-open breaker, got state %v", state())
+	}
+	c.Report(endpoint, true)
+	if state() != 1 || trips() != 2 {
+		t.Errorf("Expected a failed probe to trip the breaker again, got state %v and %v trips", state(), trips())
+	}
+	now = now.Add(time.Minute)
+	c.Allow(endpoint)
+	c.Report(endpoint, false)
+	if state() != 0 || trips() != 2 {
+		t.Errorf("Expected a closed breaker, got state %v and %v trips", state(), trips())
+	}
+}
+
+func TestCircuitBreakerSkipsUnroutedHosts(t *testing.T) {
+	breakers := &CircuitBreakers{Failures: 1, OpenDuration: time.Minute}
+	ps := &ProxyServer{destinationResolver: &resolver.Subnet{}, breakers: breakers}
+	for _, host := range []string{"unrouted-a.invalid", "unrouted-b.invalid"} {
+		w := httptest.NewRecorder()
+		ps.Handler(w, httptest.NewRequest("GET", "http://"+host+"/", nil))
+		if w.Code != http.StatusBadGateway {
+			t.Errorf("Expected a bad gateway for %s, got %d", host, w.Code)
+		}
+	}
+	if statuses := breakers.Statuses(); len(statuses) != 0 {
+		t.Errorf("Expected no breaker for hosts only the fallback proxies, got %v", statuses)
+	}
+}
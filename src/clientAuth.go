@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gateway/resolver"
+)
+
+// Headers telling the backend of a route requiring a client certificate who
+// the verified client is. Clients can not set them, they are removed from
+// every request.
+const (
+	clientCertSubjectHeader     = "X-Client-Cert-Subject"
+	clientCertSANsHeader        = "X-Client-Cert-Alt-Names"
+	clientCertFingerprintHeader = "X-Client-Cert-Fingerprint"
+)
+
+// clientCAPools keeps the CA bundles of the routes by path, and reads a bundle
+// again once its file changed.
+type clientCAPools struct {
+	mu    sync.Mutex
+	pools map[string]*clientCAPool
+}
+
+type clientCAPool struct {
+	modified time.Time
+	pool     *x509.CertPool
+}
+
+func (c *clientCAPools) get(path string) (*x509.CertPool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, found := c.pools[path]; found && cached.modified.Equal(info.ModTime()) {
+		return cached.pool, nil
+	}
+	pool, err := loadClientCAs(path)
+	if err != nil {
+		return nil, err
+	}
+	if c.pools == nil {
+		c.pools = map[string]*clientCAPool{}
+	}
+	c.pools[path] = &clientCAPool{modified: info.ModTime(), pool: pool}
+	return pool, nil
+}
+
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No CA certificate found in %s", path)
+	}
+	return pool, nil
+}
+
+// validClientAuth checks the client CAs of a route can be loaded, and that
+// the route is not served over plain http, where there is no certificate.
+func validClientAuth(route *resolver.Route) error {
+	if route.ClientCA == "" {
+		if len(route.ClientSubjects) > 0 {
+			return errors.New("client-subjects without client-ca")
+		}
+		return nil
+	}
+	if route.HTTP {
+		return errors.New("client-ca requires https, the route is served over http")
+	}
+	_, err := loadClientCAs(route.ClientCA)
+	return err
+}
+
+// verifyClient checks the client certificate of the request is signed by
+// the CAs of the route, and belongs to one of its subjects when the route
+// lists them. It returns the verified certificate.
+func (c *clientCAPools) verifyClient(r *http.Request, route *resolver.Route) (*x509.Certificate, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, errors.New("Client certificate required")
+	}
+	roots, err := c.get(route.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load the client CAs of %s: %v", route, err)
+	}
+	cert := r.TLS.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, intermediate := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(intermediate)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return nil, fmt.Errorf("Invalid client certificate: %v", err)
+	}
+	if len(route.ClientSubjects) > 0 && !subjectAllowed(cert, route.ClientSubjects) {
+		return nil, fmt.Errorf("Client certificate %s is not allowed", cert.Subject.CommonName)
+	}
+	return cert, nil
+}
+
+// clientSANs returns the alternative names of the certificate
+func clientSANs(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+func subjectAllowed(cert *x509.Certificate, allowed []string) bool {
+	names := append(clientSANs(cert), cert.Subject.CommonName, cert.Subject.String())
+	for _, subject := range allowed {
+		for _, name := range names {
+			if strings.EqualFold(subject, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// withClientCert returns the request with the client certificate headers
+// of cert, without any when cert is nil. The request is copied when they
+// change, as the headers received are still reported by the inspector.
+func withClientCert(r *http.Request, cert *x509.Certificate) *http.Request {
+	header := r.Header
+	if cert == nil && header.Get(clientCertSubjectHeader) == "" && header.Get(clientCertSANsHeader) == "" && header.Get(clientCertFingerprintHeader) == "" {
+		return r
+	}
+	r = r.Clone(r.Context())
+	header = r.Header
+	header.Del(clientCertSubjectHeader)
+	header.Del(clientCertSANsHeader)
+	header.Del(clientCertFingerprintHeader)
+	if cert == nil {
+		return r
+	}
+	header.Set(clientCertSubjectHeader, cert.Subject.String())
+	if sans := clientSANs(cert); len(sans) > 0 {
+		header.Set(clientCertSANsHeader, strings.Join(sans, ","))
+	}
+	header.Set(clientCertFingerprintHeader, fmt.Sprintf("%x", sha256.Sum256(cert.Raw)))
+	return r
+}
+
+// wantsClientCert tells whether the host has a route requiring a client
+// certificate. Browsers prompt for a certificate whenever the server asks
+// for one, so only these hosts do. The resolvers collect the hosts as their
+// routes change, as this runs on every handshake.
+func (s *ProxyServer) wantsClientCert(host string) bool {
+	router, ok := s.destinationResolver.(resolver.ClientCertRouter)
+	return ok && router.WantsClientCert(host)
+}
+
+// clientAuthConfig returns the GetConfigForClient callback asking the hosts
+// with routes requiring a client certificate for one. It is verified by the
+// proxy handler, against the CAs of the route the request matches.
+func (s *ProxyServer) clientAuthConfig(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	withClientAuth := base.Clone()
+	withClientAuth.ClientAuth = tls.RequestClientCert
+	if len(withClientAuth.NextProtos) == 0 {
+		withClientAuth.NextProtos = []string{"h2", "http/1.1"}
+	}
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if s.wantsClientCert(hello.ServerName) {
+			return withClientAuth, nil
+		}
+		return nil, nil
+	}
+}
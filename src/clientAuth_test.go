@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gateway/resolver"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) issue(t *testing.T, name string, emails ...string) *x509.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        pkix.Name{CommonName: name, Organization: []string{"Ops"}},
+		EmailAddresses: emails,
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func TestClientCertificateRoutes(t *testing.T) {
+	ca, other := newTestCA(t, "Clients CA"), newTestCA(t, "Other CA")
+	dir, err := ioutil.TempDir("", "client-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bundle := filepath.Join(dir, "clients.pem")
+	if err := ioutil.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer backend.Close()
+	address := strings.TrimPrefix(backend.URL, "http://")
+	host, port, _ := net.SplitHostPort(address)
+	portNumber, _ := strconv.ParseUint(port, 10, 16)
+	subnet := &resolver.Subnet{}
+	subnet.SetRoutes(append(resolver.ParseProxyMappings("shop:"+address),
+		resolver.Route{Name: "console", Host: "console", Destination: host, Port: uint16(portNumber), ClientCA: bundle, ClientSubjects: []string{"ops@example.com"}}))
+	ps := &ProxyServer{destinationResolver: subnet}
+
+	request := func(host string, certs ...*x509.Certificate) *httptest.ResponseRecorder {
+		received = nil
+		r := httptest.NewRequest("GET", "https://"+host+"/", nil)
+		r.Header.Set(clientCertSubjectHeader, "CN=spoofed")
+		r.TLS.PeerCertificates = certs
+		w := httptest.NewRecorder()
+		ps.Handler(w, r)
+		return w
+	}
+
+	for name, certs := range map[string][]*x509.Certificate{
+		"no certificate":      nil,
+		"unknown CA":          {other.issue(t, "ops", "ops@example.com")},
+		"subject not allowed": {ca.issue(t, "dev", "dev@example.com")},
+	} {
+		if w := request("console", certs...); w.Code != http.StatusForbidden || received != nil {
+			t.Errorf("Expected %s to be refused, got %d", name, w.Code)
+		}
+	}
+
+	allowed := ca.issue(t, "ops", "ops@example.com")
+	if w := request("console", allowed); w.Code != http.StatusOK {
+		t.Fatalf("Expected the allowed client to get through, got %d %s", w.Code, w.Body)
+	}
+	if subject := received.Get(clientCertSubjectHeader); subject != "CN=ops,O=Ops" {
+		t.Errorf("Unexpected subject %q", subject)
+	}
+	if sans := received.Get(clientCertSANsHeader); sans != "ops@example.com" {
+		t.Errorf("Unexpected alternative names %q", sans)
+	}
+	if len(received.Get(clientCertFingerprintHeader)) != 64 {
+		t.Errorf("Expected a sha256 fingerprint, got %q", received.Get(clientCertFingerprintHeader))
+	}
+
+	if w := request("shop", allowed); w.Code != http.StatusOK || received.Get(clientCertSubjectHeader) != "" {
+		t.Errorf("Expected client certificate headers to be removed on other routes, got %d %v", w.Code, received)
+	}
+
+	base := &tls.Config{}
+	getConfig := ps.clientAuthConfig(base)
+	for _, host := range []string{"console", "Console.example.test"} {
+		if config, _ := getConfig(&tls.ClientHelloInfo{ServerName: host}); config == nil || config.ClientAuth != tls.RequestClientCert {
+			t.Errorf("Expected a client certificate to be requested for %s", host)
+		}
+	}
+	if config, _ := getConfig(&tls.ClientHelloInfo{ServerName: "shop"}); config != nil {
+		t.Error("Expected no client certificate to be requested for shop")
+	}
+}
+
+func TestValidClientAuth(t *testing.T) {
+	if err := validClientAuth(&resolver.Route{ClientSubjects: []string{"ops"}}); err == nil {
+		t.Error("Expected client-subjects without client-ca to be refused")
+	}
+	if err := validClientAuth(&resolver.Route{ClientCA: "/nonexistent.pem"}); err == nil {
+		t.Error("Expected a missing bundle to be refused")
+	}
+	dir, err := ioutil.TempDir("", "client-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bundle := filepath.Join(dir, "clients.pem")
+	ioutil.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: newTestCA(t, "CA").cert.Raw}), 0644)
+	if err := validClientAuth(&resolver.Route{ClientCA: bundle, HTTP: true}); err == nil {
+		t.Error("Expected client-ca on a plain http route to be refused")
+	}
+	if err := validClientAuth(&resolver.Route{ClientCA: bundle}); err != nil {
+		t.Error(err)
+	}
+}
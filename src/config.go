@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"gateway/resolver"
+)
+
+// Config is the layout of the -config file. Every setting in it can still be
+// overridden by the matching environment variable or command line flag.
+type Config struct {
+	Listen         ListenConfig         `yaml:"listen"`
+	Inspector      InspectorConfig      `yaml:"inspector"`
+	TLS            TLSConfig            `yaml:"tls"`
+	Resolver       ResolverConfig       `yaml:"resolver"`
+	LoadBalancing  LoadBalancingConfig  `yaml:"load-balancing"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit-breaker"`
+	Retries        RetriesConfig        `yaml:"retries"`
+	Admin          AdminConfig          `yaml:"admin"`
+	AccessLog      AccessLogConfig      `yaml:"access-log"`
+	Tracing        TracingFileConfig    `yaml:"tracing"`
+	Routes         []resolver.Route     `yaml:"routes"`
+}
+
+type ListenConfig struct {
+	HTTP      int64 `yaml:"http"`
+	HTTPS     int64 `yaml:"https"`
+	Inspector int64 `yaml:"inspector"`
+	Admin     int64 `yaml:"admin"`
+}
+
+type InspectorConfig struct {
+	BufferSize int   `yaml:"buffer-size"`
+	BodyLimit  int64 `yaml:"body-limit"`
+}
+
+type AdminConfig struct {
+	// Token is the bearer token admin API requests must carry
+	Token string `yaml:"token"`
+}
+
+type AccessLogConfig struct {
+	// Output is stdout, stderr, a file path, or off
+	Output string `yaml:"output"`
+	// Format is combined, json or logfmt
+	Format string `yaml:"format"`
+	// MaxSize is the size in megabytes a file is rotated at (nil when left
+	// out, 0 disables rotation), MaxBackups the number of rotated files kept
+	MaxSize    *int64 `yaml:"max-size"`
+	MaxBackups int    `yaml:"max-backups"`
+}
+
+type TracingFileConfig struct {
+	// Exporter is otlp or file
+	Exporter     string `yaml:"exporter"`
+	OTLPEndpoint string `yaml:"otlp-endpoint"`
+	File         string `yaml:"file"`
+	ServiceName  string `yaml:"service-name"`
+	// SampleRatio is nil when left out, 0 samples no trace
+	SampleRatio *float64 `yaml:"sample-ratio"`
+}
+
+type TLSConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Hosts certificates may be requested for, on top of the routed hosts
+	Hosts []string `yaml:"hosts"`
+	// Domains restricts the routed hosts certificates are requested for to
+	// these domains and their subdomains
+	Domains []string `yaml:"domains"`
+	// Mode is acme to request certificates from Let's Encrypt, or local-ca
+	// to issue them from a local CA kept in CADir
+	Mode  string `yaml:"mode"`
+	CADir string `yaml:"ca-dir"`
+	// ACME is the server certificates are requested from, CacheDir keeps
+	// the certificates it issued
+	ACME     ACMEFileConfig `yaml:"acme"`
+	CacheDir string         `yaml:"cache-dir"`
+	// CertificatesDir and Certificates hold certificates served instead of
+	// requesting them, for the hosts they cover
+	CertificatesDir string            `yaml:"certificates-dir"`
+	Certificates    []CertificatePair `yaml:"certificates"`
+}
+
+type ACMEFileConfig struct {
+	// Directory is the ACME server directory URL, staging for Let's Encrypt
+	// staging
+	Directory string `yaml:"directory"`
+	Email     string `yaml:"email"`
+	// EABKeyID and EABKey (base64url) are the external account binding
+	EABKeyID string `yaml:"eab-kid"`
+	EABKey   string `yaml:"eab-key"`
+	// Challenges are http-01 and/or tls-alpn-01
+	Challenges []string `yaml:"challenges"`
+}
+
+type LoadBalancingConfig struct {
+	// Policy is one of round-robin, least-connections, random or hash
+	Policy     string `yaml:"policy"`
+	HashHeader string `yaml:"hash-header"`
+	HashCookie string `yaml:"hash-cookie"`
+}
+
+type CircuitBreakerConfig struct {
+	// Failures and ErrorRate are nil when left out, 0 disables them
+	Failures     *int          `yaml:"failures"`
+	ErrorRate    *float64      `yaml:"error-rate"`
+	Window       int           `yaml:"window"`
+	OpenDuration time.Duration `yaml:"open-duration"`
+}
+
+type RetriesConfig struct {
+	// Attempts is nil when left out, 0 disables retries
+	Attempts *int          `yaml:"attempts"`
+	Backoff  time.Duration `yaml:"backoff"`
+}
+
+type ResolverConfig struct {
+	Name                 string       `yaml:"name"`
+	ProxyOnlyMappedHosts bool         `yaml:"proxy-only-mapped-hosts"`
+	Docker               DockerConfig `yaml:"docker"`
+}
+
+type DockerConfig struct {
+	BaseHostname      string `yaml:"base-hostname"`
+	GatewayIP         string `yaml:"gateway-ip"`
+	StackSearchString string `yaml:"stack-search-string"`
+	StackLabel        string `yaml:"stack-label"`
+	HealthLabel       string `yaml:"health-label"`
+	// NetworkRouting routes to containers over the networks they share with
+	// the gateway, Networks overrides which networks those are
+	NetworkRouting bool     `yaml:"network-routing"`
+	Networks       []string `yaml:"networks"`
+	// Weights share the traffic of a deployment between its stacks, by stack
+	// name in percent, StickyCookie keeps clients on the stack they got
+	Weights      map[string]int `yaml:"weights"`
+	StickyCookie string         `yaml:"sticky-cookie"`
+	// TrustedProxies are the ips or networks of the proxies in front of the
+	// gateway, whose X-Forwarded-For tells the client ip
+	TrustedProxies []string `yaml:"trusted-proxies"`
+}
+
+// loadConfig reads a YAML configuration file. Unknown keys are rejected, so a
+// misspelled setting fails loudly instead of silently falling back to the
+// default.
+func loadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for n := range config.Routes {
+		if err := checkRoute(&config.Routes[n]); err != nil {
+			return nil, fmt.Errorf("%s: route %d: %v", path, n+1, err)
+		}
+	}
+	return config, nil
+}
+
+// checkRoute fills in the defaults of a route and validates it. Routes of
+// the config file and overrides added through the admin API go through it.
+func checkRoute(route *resolver.Route) error {
+	if route.Host == "" {
+		return errors.New("no host")
+	}
+	if route.Destination == "" {
+		route.Destination = route.Host
+	}
+	if route.Port == 0 {
+		route.Port = 80
+	}
+	if route.Name == "" {
+		route.Name = route.Host
+	}
+	if err := route.Validate(); err != nil {
+		return err
+	}
+	return validClientAuth(route)
+}
+
+// flagValues returns the settings of the file keyed by the flag they set.
+// Settings left out of the file are left out here as well.
+func (c *Config) flagValues() map[string]string {
+	values := map[string]string{}
+	set := func(name, value string, isSet bool) {
+		if isSet {
+			values[name] = value
+		}
+	}
+	setInt := func(name string, value int64) {
+		set(name, strconv.FormatInt(value, 10), value != 0)
+	}
+	// the settings 0 is meaningful for are set whenever present in the file
+	setIntPtr := func(name string, value *int64) {
+		if value != nil {
+			set(name, strconv.FormatInt(*value, 10), true)
+		}
+	}
+	setFloatPtr := func(name string, value *float64) {
+		if value != nil {
+			set(name, strconv.FormatFloat(*value, 'f', -1, 64), true)
+		}
+	}
+	setInt("port", c.Listen.HTTP)
+	setInt("port-https", c.Listen.HTTPS)
+	setInt("port-inspector", c.Listen.Inspector)
+	setInt("port-admin", c.Listen.Admin)
+	set("admin-token", c.Admin.Token, c.Admin.Token != "")
+	setInt("inspector-buffer-size", int64(c.Inspector.BufferSize))
+	setInt("inspector-body-limit", c.Inspector.BodyLimit)
+	set("https", "true", c.TLS.Enabled)
+	set("tls-domains", strings.Join(c.TLS.Domains, ","), len(c.TLS.Domains) > 0)
+	set("tls-mode", c.TLS.Mode, c.TLS.Mode != "")
+	set("tls-ca-dir", c.TLS.CADir, c.TLS.CADir != "")
+	set("acme-directory", c.TLS.ACME.Directory, c.TLS.ACME.Directory != "")
+	set("acme-email", c.TLS.ACME.Email, c.TLS.ACME.Email != "")
+	set("acme-eab-kid", c.TLS.ACME.EABKeyID, c.TLS.ACME.EABKeyID != "")
+	set("acme-eab-key", c.TLS.ACME.EABKey, c.TLS.ACME.EABKey != "")
+	set("acme-challenges", strings.Join(c.TLS.ACME.Challenges, ","), len(c.TLS.ACME.Challenges) > 0)
+	set("tls-cache-dir", c.TLS.CacheDir, c.TLS.CacheDir != "")
+	set("tls-certificates-dir", c.TLS.CertificatesDir, c.TLS.CertificatesDir != "")
+	pairs := []string{}
+	for _, pair := range c.TLS.Certificates {
+		if pair.Key == "" {
+			pairs = append(pairs, pair.Cert)
+		} else {
+			pairs = append(pairs, pair.Cert+":"+pair.Key)
+		}
+	}
+	set("tls-certificates", strings.Join(pairs, ","), len(pairs) > 0)
+	set("access-log", c.AccessLog.Output, c.AccessLog.Output != "")
+	set("access-log-format", c.AccessLog.Format, c.AccessLog.Format != "")
+	setIntPtr("access-log-max-size", c.AccessLog.MaxSize)
+	setInt("access-log-max-backups", int64(c.AccessLog.MaxBackups))
+	set("tracing", c.Tracing.Exporter, c.Tracing.Exporter != "")
+	set("tracing-otlp-endpoint", c.Tracing.OTLPEndpoint, c.Tracing.OTLPEndpoint != "")
+	set("tracing-file", c.Tracing.File, c.Tracing.File != "")
+	set("tracing-service-name", c.Tracing.ServiceName, c.Tracing.ServiceName != "")
+	setFloatPtr("tracing-sample-ratio", c.Tracing.SampleRatio)
+	set("load-balancing", c.LoadBalancing.Policy, c.LoadBalancing.Policy != "")
+	set("load-balancing-hash-header", c.LoadBalancing.HashHeader, c.LoadBalancing.HashHeader != "")
+	set("load-balancing-hash-cookie", c.LoadBalancing.HashCookie, c.LoadBalancing.HashCookie != "")
+	setIntPtr("circuit-breaker-failures", int64Ptr(c.CircuitBreaker.Failures))
+	setFloatPtr("circuit-breaker-error-rate", c.CircuitBreaker.ErrorRate)
+	setInt("circuit-breaker-window", int64(c.CircuitBreaker.Window))
+	set("circuit-breaker-open-duration", c.CircuitBreaker.OpenDuration.String(), c.CircuitBreaker.OpenDuration != 0)
+	setIntPtr("retries", int64Ptr(c.Retries.Attempts))
+	set("retry-backoff", c.Retries.Backoff.String(), c.Retries.Backoff != 0)
+	set("destination-resolver", c.Resolver.Name, c.Resolver.Name != "")
+	set("proxy-only-mapped-hosts", "true", c.Resolver.ProxyOnlyMappedHosts)
+	set("base-hostname", c.Resolver.Docker.BaseHostname, c.Resolver.Docker.BaseHostname != "")
+	set("gateway-ip", c.Resolver.Docker.GatewayIP, c.Resolver.Docker.GatewayIP != "")
+	set("stack-search-string", c.Resolver.Docker.StackSearchString, c.Resolver.Docker.StackSearchString != "")
+	set("docker-stack-label", c.Resolver.Docker.StackLabel, c.Resolver.Docker.StackLabel != "")
+	set("docker-health-label", c.Resolver.Docker.HealthLabel, c.Resolver.Docker.HealthLabel != "")
+	set("docker-network-routing", "true", c.Resolver.Docker.NetworkRouting)
+	set("docker-networks", strings.Join(c.Resolver.Docker.Networks, ","), len(c.Resolver.Docker.Networks) > 0)
+	set("docker-sticky-cookie", c.Resolver.Docker.StickyCookie, c.Resolver.Docker.StickyCookie != "")
+	set("docker-trusted-proxies", strings.Join(c.Resolver.Docker.TrustedProxies, ","), len(c.Resolver.Docker.TrustedProxies) > 0)
+	return values
+}
+
+func int64Ptr(value *int) *int64 {
+	if value == nil {
+		return nil
+	}
+	n := int64(*value)
+	return &n
+}
+
+// exportEnv hands the settings of the file to the flag parser through the
+// environment. Flags are registered in several places (the resolvers add their
+// own when configured), and the environment is the one source every parse
+// reads. Variables that are already set win, as do command line flags.
+func (c *Config) exportEnv() error {
+	for name, value := range c.flagValues() {
+		key := strings.ToUpper(strings.Replace(name, "-", "_", -1))
+		if _, found := os.LookupEnv(key); found {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return fmt.Errorf("Unable to apply config setting '%s': %v", name, err)
+		}
+	}
+	return nil
+}
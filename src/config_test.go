@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "gateway-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+listen:
+  http: 8080
+resolver:
+  name: docker
+routes:
+  - host: web
+  - host: nats
+    destination: nats-streaming-console
+    port: 8282
+    health-check:
+      path: /healthz
+      interval: 5s
+`)
+	defer os.Remove(path)
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Routes) != 2 {
+		t.Fatalf("Expected 2 routes, got %d", len(config.Routes))
+	}
+	if target := config.Routes[0].Target(); target != "web:80" {
+		t.Errorf("Route without destination should default to its host on port 80, got %s", target)
+	}
+	if target := config.Routes[1].Target(); target != "nats-streaming-console:8282" {
+		t.Errorf("Unexpected route target %s", target)
+	}
+	if check := config.Routes[1].HealthCheck; check == nil || check.Path != "/healthz" || check.Interval != 5*time.Second {
+		t.Errorf("Unexpected health check %+v", check)
+	}
+	values := config.flagValues()
+	if values["port"] != "8080" || values["destination-resolver"] != "docker" {
+		t.Errorf("Config settings should map onto flags, got %v", values)
+	}
+	if _, found := values["port-inspector"]; found {
+		t.Errorf("Settings left out of the file should not override flag defaults, got %v", values)
+	}
+}
+
+func TestLoadConfigRejectsUnknownKeys(t *testing.T) {
+	path := writeConfig(t, `
+listen:
+  http: 8080
+routes:
+  - host: web
+    destinaton: test
+`)
+	defer os.Remove(path)
+
+	_, err := loadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "line 6: field destinaton not found") {
+		t.Errorf("Unknown keys should be rejected with their line number, got %v", err)
+	}
+}
+
+func TestLoadConfigExplicitZero(t *testing.T) {
+	path := writeConfig(t, `
+retries:
+  attempts: 0
+circuit-breaker:
+  failures: 0
+  error-rate: 0
+access-log:
+  max-size: 0
+tracing:
+  sample-ratio: 0
+`)
+	defer os.Remove(path)
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := config.flagValues()
+	for _, name := range []string{"retries", "circuit-breaker-failures", "circuit-breaker-error-rate", "access-log-max-size", "tracing-sample-ratio"} {
+		if value, found := values[name]; value != "0" {
+			t.Errorf("Expected %s: 0 to override the flag default, got %q (%v)", name, value, found)
+		}
+	}
+
+	if values := (&Config{}).flagValues(); len(values) != 0 {
+		t.Errorf("Expected settings left out of the file to be left out, got %v", values)
+	}
+}
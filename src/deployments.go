@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"gateway/resolver"
+)
+
+// deploymentsStatusHandler serves how deployments are split between their
+// stacks, without the actions moving their traffic.
+func deploymentsStatusHandler(manager resolver.DeploymentManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, manager.Deployments())
+	}
+}
+
+// deploymentsHandler serves how deployments are split between their stacks,
+// and moves their traffic on POST /api/deployments/{name}/promote[?stack=],
+// /rollback and /unpin.
+func deploymentsHandler(manager resolver.DeploymentManager) http.HandlerFunc {
+	status := deploymentsStatusHandler(manager)
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/deployments"), "/")
+		if path == "" {
+			status(w, r)
+			return
+		}
+
+		parts := strings.Split(path, "/")
+		if len(parts) != 2 {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var err error
+		switch name := parts[0]; parts[1] {
+		case "promote":
+			err = manager.Promote(name, r.URL.Query().Get("stack"))
+		case "rollback":
+			err = manager.Rollback(name)
+		case "unpin":
+			err = manager.Unpin(name)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, manager.Deployments())
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"gateway/resolver"
+)
+
+type fakeDeployments struct {
+	pinned map[string]string
+}
+
+func (f *fakeDeployments) Deployments() []resolver.DeploymentStatus {
+	return []resolver.DeploymentStatus{{Name: "shop", Pinned: f.pinned["shop"]}}
+}
+
+func (f *fakeDeployments) Promote(deployment, stack string) error {
+	if deployment != "shop" {
+		return errors.New("Unknown deployment")
+	}
+	f.pinned[deployment] = stack
+	return nil
+}
+
+func (f *fakeDeployments) Rollback(deployment string) error {
+	return f.Promote(deployment, "previous")
+}
+
+func (f *fakeDeployments) Unpin(deployment string) error {
+	return f.Promote(deployment, "")
+}
+
+func TestDeploymentsHandler(t *testing.T) {
+	manager := &fakeDeployments{pinned: map[string]string{}}
+	handler := deploymentsHandler(manager)
+	request := func(method, url string) int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(method, url, nil))
+		return w.Code
+	}
+
+	for _, test := range []struct {
+		method, url string
+		status      int
+		pinned      string
+	}{
+		{"GET", "/api/deployments", 200, ""},
+		{"POST", "/api/deployments/shop/promote?stack=shop_v2", 200, "shop_v2"},
+		{"POST", "/api/deployments/shop/rollback", 200, "previous"},
+		{"POST", "/api/deployments/shop/unpin", 200, ""},
+		{"GET", "/api/deployments/shop/promote", 405, ""},
+		{"POST", "/api/deployments/shop/restart", 404, ""},
+		{"POST", "/api/deployments/cart/promote", 400, ""},
+	} {
+		if status := request(test.method, test.url); status != test.status || manager.pinned["shop"] != test.pinned {
+			t.Errorf("Expected %s %s to answer %d and pin '%s', got %d and '%s'", test.method, test.url, test.status, test.pinned, status, manager.pinned["shop"])
+		}
+	}
+}
+
+func TestInspectorDeploymentsReadOnly(t *testing.T) {
+	manager := &fakeDeployments{pinned: map[string]string{}}
+	mux := (&Inspector{Deployments: manager}).ServeMux()
+	for _, test := range []struct {
+		method, url string
+		status      int
+	}{
+		{"GET", "/api/deployments", 200},
+		{"POST", "/api/deployments", 405},
+		{"POST", "/api/deployments/shop/promote?stack=shop_v2", 404},
+		{"POST", "/api/deployments/shop/unpin", 404},
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(test.method, test.url, nil))
+		if w.Code != test.status || manager.pinned["shop"] != "" {
+			t.Errorf("Expected %s %s to answer %d without moving traffic, got %d", test.method, test.url, test.status, w.Code)
+		}
+	}
+}
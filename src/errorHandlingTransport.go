@@ -3,35 +3,100 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // The ReverseProxy implementation does not write any meaningful response if
 // the request fails. This overwritten RoundTripper (which does not conform to
 // the round tripper specification), converts a failed request to a BAD GATEWAY
-// response
+// response. Failures are reported to the circuit breakers, and requests to
+// an endpoint whose breaker is open fail right away with SERVICE UNAVAILABLE.
+// Requests that can safely be sent again are retried, on another endpoint
+// when there is one.
 type errorHandlingTransport struct {
 	http.RoundTripper
+	breakers *CircuitBreakers
+	retries  *RetryPolicy
 }
 
 func (t errorHandlingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
-	result, err := t.RoundTripper.RoundTrip(request)
-	if err != nil {
-		result = &http.Response{
-			Status:        "BAD GATEWAY",
-			StatusCode:    http.StatusBadGateway,
-			Body:          createErrorMsg(fmt.Sprintf("Proxy error when accessing %v\n%v", request.URL, err)),
-			Proto:         request.Proto,
-			ProtoMajor:    request.ProtoMajor,
-			ProtoMinor:    request.ProtoMinor,
-			ContentLength: -1,
+	info := requestInfo(request)
+	started := time.Now()
+	defer func() { info.UpstreamLatency = time.Since(started) }()
+	var body *unreadBody
+	if request.Body != nil && request.Body != http.NoBody {
+		body = &unreadBody{ReadCloser: request.Body}
+		request.Body = body
+	}
+
+	tried := map[string]bool{}
+	for {
+		endpoint := request.URL.Host
+		tried[endpoint] = true
+		result, err := t.roundTrip(request)
+		if err != nil && t.retries.allows(info.Retries) && retryable(request, body, err) {
+			next := nextEndpoint(info.Endpoints, tried, endpoint)
+			log.Printf("Retrying %s %v on %s: %v", request.Method, request.URL, next, err)
+			if sleep(request.Context(), t.retries.backoff(info.Retries)) {
+				info.Retries++
+				info.Destination = next
+				request = request.Clone(request.Context())
+				request.URL.Host = next
+				continue
+			}
+		}
+		if err != nil {
+			result = errorResponse(request, http.StatusBadGateway, fmt.Sprintf("Proxy error when accessing %v\n%v", request.URL, err))
 		}
-		err = nil
+		if info.Retries > 0 {
+			if result.Header == nil {
+				result.Header = http.Header{}
+			}
+			result.Header.Set("X-Gateway-Retries", strconv.Itoa(info.Retries))
+		}
+		return result, nil
+	}
+}
+
+// roundTrip sends the request once, unless the circuit breaker of its
+// endpoint is open.
+func (t errorHandlingTransport) roundTrip(request *http.Request) (*http.Response, error) {
+	endpoint := request.URL.Host
+	if !t.breakers.Allow(endpoint) {
+		return errorResponse(request, http.StatusServiceUnavailable, fmt.Sprintf("Circuit breaker open for %v", endpoint)), nil
 	}
+	result, err := t.RoundTripper.RoundTrip(request)
+	t.breakers.Report(endpoint, err != nil || failedStatus(result.StatusCode))
 	return result, err
 }
 
+// failedStatus tells whether a response means the backend is unable to serve
+func failedStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+func errorResponse(request *http.Request, status int, msg string) *http.Response {
+	header := http.Header{}
+	if id := requestInfo(request).RequestID; id != "" {
+		header.Set(requestIDHeader, id)
+		msg += "\nRequest ID: " + id
+	}
+	return &http.Response{
+		Status:        strings.ToUpper(http.StatusText(status)),
+		StatusCode:    status,
+		Header:        header,
+		Body:          createErrorMsg(msg),
+		Proto:         request.Proto,
+		ProtoMajor:    request.ProtoMajor,
+		ProtoMinor:    request.ProtoMinor,
+		ContentLength: -1,
+	}
+}
+
 func createErrorMsg(str string) ClosingBuffer {
 	// Suppress "friendly error pages" in IE and Chrome.
 	if len(str) < 512 {
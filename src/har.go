@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+// The types below cover the part of the HAR 1.2 format
+// (http://www.softwareishard.com/blog/har-12-spec/) the inspector can fill in.
+
+type harLog struct {
+	Log harContent `json:"log"`
+}
+
+type harContent struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harBody        `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harBody struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func (i *Inspector) handleHAR(w http.ResponseWriter, r *http.Request) {
+	har := harLog{harContent{
+		Version: "1.2",
+		Creator: harCreator{Name: "gateway", Version: "dev"},
+		Entries: []harEntry{},
+	}}
+	exchanges := i.filter(r.URL.Query())
+	// HAR entries are expected in chronological order
+	for n := len(exchanges) - 1; n >= 0; n-- {
+		har.Log.Entries = append(har.Log.Entries, exchanges[n].harEntry())
+	}
+
+	filename := fmt.Sprintf("gateway-%s.har", time.Now().Format("20060102-150405"))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	writeJSON(w, http.StatusOK, har)
+}
+
+func (e *Exchange) harEntry() harEntry {
+	ms := float64(e.Duration) / float64(time.Millisecond)
+	entry := harEntry{
+		StartedDateTime: e.StartedAt.Format(time.RFC3339Nano),
+		Time:            ms,
+		Request: harRequest{
+			Method:      e.Method,
+			URL:         e.Scheme + "://" + e.Host + e.URL,
+			HTTPVersion: e.Proto,
+			Cookies:     harCookies((&http.Request{Header: e.RequestHeader}).Cookies()),
+			Headers:     harHeaders(e.RequestHeader),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    e.RequestBodySize,
+		},
+		Response: harResponse{
+			Status:      e.Status,
+			StatusText:  http.StatusText(e.Status),
+			HTTPVersion: e.Proto,
+			Cookies:     harCookies((&http.Response{Header: e.ResponseHeader}).Cookies()),
+			Headers:     harHeaders(e.ResponseHeader),
+			Content: harBody{
+				Size:     e.ResponseBodySize,
+				MimeType: e.ResponseHeader.Get("Content-Type"),
+			},
+			RedirectURL: e.ResponseHeader.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    e.ResponseBodySize,
+		},
+		Timings: harTimings{Send: 0, Wait: ms, Receive: 0},
+		Comment: "proxied to " + e.Destination,
+	}
+	if host, _, err := net.SplitHostPort(e.Destination); err == nil {
+		entry.ServerIPAddress = host
+	}
+	if u, err := url.ParseRequestURI(e.URL); err == nil {
+		for name, values := range u.Query() {
+			for _, value := range values {
+				entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{name, value})
+			}
+		}
+	}
+	entry.Response.Content.Text, entry.Response.Content.Encoding = harText(e.ResponseBody, e.ResponseHeader)
+	if e.RequestBodySize > 0 {
+		entry.Request.PostData = &harPostData{MimeType: e.RequestHeader.Get("Content-Type")}
+		entry.Request.PostData.Text, entry.Request.PostData.Encoding = harText(e.RequestBody, e.RequestHeader)
+	}
+	if e.ResponseBodyTruncated {
+		entry.Response.Content.Comment = fmt.Sprintf("truncated to %d bytes", len(e.ResponseBody))
+	}
+	return entry
+}
+
+// harText returns the body as HAR text, base64 encoded when it is not text:
+// content encoded (compressed) bodies, or bodies which are not valid UTF-8,
+// would be mangled by the JSON encoding otherwise.
+func harText(body string, header http.Header) (text, encoding string) {
+	if header.Get("Content-Encoding") == "" && utf8.ValidString(body) {
+		return body, ""
+	}
+	return base64.StdEncoding.EncodeToString([]byte(body)), "base64"
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := []harNameValue{}
+	for _, name := range names {
+		for _, value := range header[name] {
+			pairs = append(pairs, harNameValue{name, value})
+		}
+	}
+	return pairs
+}
+
+func harCookies(cookies []*http.Cookie) []harNameValue {
+	pairs := []harNameValue{}
+	for _, cookie := range cookies {
+		pairs = append(pairs, harNameValue{cookie.Name, cookie.Value})
+	}
+	return pairs
+}
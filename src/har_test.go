@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gateway/resolver"
+)
+
+func TestHAR(t *testing.T) {
+	compressed := &bytes.Buffer{}
+	zw := gzip.NewWriter(compressed)
+	zw.Write([]byte(`{"orders": []}`))
+	zw.Close()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1"})
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+	defer backend.Close()
+	subnet := &resolver.Subnet{}
+	subnet.SetRoutes(resolver.ParseProxyMappings("shop:" + strings.TrimPrefix(backend.URL, "http://")))
+	inspector := &Inspector{Capacity: 10, BodyLimit: 1024}
+	handler := inspector.Wrap((&ProxyServer{destinationResolver: subnet}).Handler)
+
+	r := httptest.NewRequest("POST", "http://shop/orders?page=2", strings.NewReader("\xff\xfebinary"))
+	r.Header.Set("Content-Type", "application/octet-stream")
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.AddCookie(&http.Cookie{Name: "stack", Value: "feature-42"})
+	handler(httptest.NewRecorder(), r)
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "http://shop/health", nil))
+
+	w := httptest.NewRecorder()
+	inspector.ServeMux().ServeHTTP(w, httptest.NewRequest("GET", "/api/har?ids=1", nil))
+	if !strings.Contains(w.Header().Get("Content-Disposition"), ".har") {
+		t.Errorf("Expected a HAR attachment, got %q", w.Header().Get("Content-Disposition"))
+	}
+	har := harLog{}
+	if err := json.Unmarshal(w.Body.Bytes(), &har); err != nil {
+		t.Fatal(err)
+	}
+	if har.Log.Version != "1.2" || len(har.Log.Entries) != 1 {
+		t.Fatalf("Expected a HAR 1.2 log of the selected exchange, got %s", w.Body)
+	}
+	entry := har.Log.Entries[0]
+	request, response := entry.Request, entry.Response
+	if request.Method != "POST" || request.URL != "http://shop/orders?page=2" || entry.ServerIPAddress != "127.0.0.1" {
+		t.Errorf("Unexpected request %+v to %s", request, entry.ServerIPAddress)
+	}
+	if len(request.QueryString) != 1 || request.QueryString[0] != (harNameValue{"page", "2"}) {
+		t.Errorf("Unexpected query string %v", request.QueryString)
+	}
+	if len(request.Cookies) != 1 || request.Cookies[0] != (harNameValue{"stack", "feature-42"}) {
+		t.Errorf("Unexpected request cookies %v", request.Cookies)
+	}
+	if len(response.Cookies) != 1 || response.Cookies[0] != (harNameValue{"session", "s1"}) {
+		t.Errorf("Unexpected response cookies %v", response.Cookies)
+	}
+
+	postData := request.PostData
+	if body, _ := base64.StdEncoding.DecodeString(postData.Text); postData.Encoding != "base64" || string(body) != "\xff\xfebinary" {
+		t.Errorf("Expected the binary request body base64 encoded, got %+v", postData)
+	}
+	content := response.Content
+	if body, _ := base64.StdEncoding.DecodeString(content.Text); response.Status != 200 || content.Encoding != "base64" || !bytes.Equal(body, compressed.Bytes()) {
+		t.Errorf("Expected the compressed response body base64 encoded, got %d %+v", response.Status, content)
+	}
+	if content.MimeType != "application/json" || content.Size != int64(compressed.Len()) {
+		t.Errorf("Unexpected content %+v", content)
+	}
+
+	text := (&Exchange{ResponseBody: "plain", ResponseHeader: http.Header{}}).harEntry().Response.Content
+	if text.Text != "plain" || text.Encoding != "" {
+		t.Errorf("Expected text bodies as they are, got %+v", text)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"gateway/resolver"
+)
+
+// withHealthCheckDefaults fills in the settings a route left out.
+func withHealthCheckDefaults(check resolver.HealthCheck) resolver.HealthCheck {
+	if check.Type == "" {
+		check.Type = "http"
+	}
+	if check.Path == "" && check.Type == "http" {
+		check.Path = "/"
+	}
+	if check.Interval <= 0 {
+		check.Interval = 10 * time.Second
+	}
+	if check.Timeout <= 0 {
+		check.Timeout = 2 * time.Second
+	}
+	if check.HealthyThreshold <= 0 {
+		check.HealthyThreshold = 2
+	}
+	if check.UnhealthyThreshold <= 0 {
+		check.UnhealthyThreshold = 3
+	}
+	return check
+}
+
+// HealthStatus is the state of an endpoint, as last probed.
+type HealthStatus struct {
+	Route     string    `json:"route"`
+	Endpoint  string    `json:"endpoint"`
+	Type      string    `json:"type"`
+	Path      string    `json:"path,omitempty"`
+	Up        bool      `json:"up"`
+	Since     time.Time `json:"since"`
+	CheckedAt time.Time `json:"checkedAt"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+type healthTarget struct {
+	status HealthStatus
+	host   string
+	check  resolver.HealthCheck
+	stop   chan struct{}
+
+	// successes and failures count the checks passed or failed in a row
+	successes int
+	failures  int
+}
+
+// HealthChecker probes the endpoints of the routes that have a health check.
+// Endpoints are considered up until they fail enough checks in a row, so new
+// replicas get traffic right away.
+type HealthChecker struct {
+	mu      sync.RWMutex
+	targets map[string]*healthTarget
+}
+
+func healthKey(endpoint string, check resolver.HealthCheck) string {
+	return fmt.Sprintf("%s %+v", endpoint, check)
+}
+
+// Watch keeps probing the endpoints of the destinations, and picks up routes
+// and endpoints coming and going every interval.
+func (c *HealthChecker) Watch(destinations func() []resolver.Destination, interval time.Duration) {
+	for {
+		c.sync(destinations())
+		time.Sleep(interval)
+	}
+}
+
+// sync starts checking new endpoints and stops checking the ones gone.
+func (c *HealthChecker) sync(destinations []resolver.Destination) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.targets == nil {
+		c.targets = map[string]*healthTarget{}
+	}
+
+	current := map[string]bool{}
+	for _, destination := range destinations {
+		route := destination.Route
+		if route == nil || route.HealthCheck == nil {
+			continue
+		}
+		check := withHealthCheckDefaults(*route.HealthCheck)
+		for _, endpoint := range destination.Endpoints {
+			key := healthKey(endpoint, check)
+			current[key] = true
+			if _, found := c.targets[key]; found {
+				continue
+			}
+			t := &healthTarget{
+				status: HealthStatus{Route: route.Name, Endpoint: endpoint, Type: check.Type, Path: check.Path, Up: true, Since: time.Now()},
+				host:   route.Host,
+				check:  check,
+				stop:   make(chan struct{}),
+			}
+			c.targets[key] = t
+			go c.probe(t)
+		}
+	}
+	for key, t := range c.targets {
+		if !current[key] {
+			close(t.stop)
+			delete(c.targets, key)
+		}
+	}
+}
+
+func (c *HealthChecker) probe(t *healthTarget) {
+	ticker := time.NewTicker(t.check.Interval)
+	defer ticker.Stop()
+	for {
+		c.report(t, runCheck(t.status.Endpoint, t.host, t.check))
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runCheck probes the endpoint once, host is sent as the Host header.
+func runCheck(endpoint, host string, check resolver.HealthCheck) error {
+	if check.Type == "tcp" {
+		conn, err := net.DialTimeout("tcp", endpoint, check.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequest("GET", "http://"+endpoint+check.Path, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = host
+	client := &http.Client{
+		Timeout: check.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("Health check returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (c *HealthChecker) report(t *healthTarget, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := &t.status
+	status.CheckedAt = time.Now()
+	if err != nil {
+		status.LastError = err.Error()
+		t.successes, t.failures = 0, t.failures+1
+		if status.Up && t.failures >= t.check.UnhealthyThreshold {
+			status.Up, status.Since = false, status.CheckedAt
+			log.Printf("Endpoint %s of %s is down: %v", status.Endpoint, status.Route, err)
+		}
+		return
+	}
+	status.LastError = ""
+	t.successes, t.failures = t.successes+1, 0
+	if !status.Up && t.successes >= t.check.HealthyThreshold {
+		status.Up, status.Since = true, status.CheckedAt
+		log.Printf("Endpoint %s of %s is up", status.Endpoint, status.Route)
+	}
+}
+
+// Healthy returns the destination without the endpoints that are down.
+func (c *HealthChecker) Healthy(destination resolver.Destination) resolver.Destination {
+	if c == nil || destination.Route == nil || destination.Route.HealthCheck == nil {
+		return destination
+	}
+	check := withHealthCheckDefaults(*destination.Route.HealthCheck)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	endpoints := []string{}
+	for _, endpoint := range destination.Endpoints {
+		if t, found := c.targets[healthKey(endpoint, check)]; found && !t.status.Up {
+			continue
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	destination.Endpoints = endpoints
+	destination.HostPort = ""
+	if len(endpoints) > 0 {
+		destination.HostPort = endpoints[0]
+	}
+	return destination
+}
+
+// Statuses returns the state of every endpoint checked, by route.
+func (c *HealthChecker) Statuses() []HealthStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	statuses := []HealthStatus{}
+	for _, t := range c.targets {
+		statuses = append(statuses, t.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Route != statuses[j].Route {
+			return statuses[i].Route < statuses[j].Route
+		}
+		return statuses[i].Endpoint < statuses[j].Endpoint
+	})
+	return statuses
+}
+
+func (c *HealthChecker) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, c.Statuses())
+}
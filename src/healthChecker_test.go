@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gateway/resolver"
+)
+
+// waitFor polls until the condition holds, health checks run on their own
+// goroutines
+func waitFor(t *testing.T, description string, condition func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", description)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHealthCheckerHTTP(t *testing.T) {
+	var failing int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || r.Host != "web" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+	// nothing listens on a closed listener's address
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	down := l.Addr().String()
+	l.Close()
+	up := strings.TrimPrefix(backend.URL, "http://")
+
+	route := &resolver.Route{Name: "web", Host: "web", HealthCheck: &resolver.HealthCheck{
+		Path:               "/healthz",
+		Interval:           10 * time.Millisecond,
+		Timeout:            time.Second,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 2,
+	}}
+	destination := resolver.Destination{Route: route, HostPort: down, Endpoints: []string{down, up}}
+
+	c := &HealthChecker{}
+	c.sync([]resolver.Destination{destination})
+	defer c.sync(nil)
+
+	healthy := func() []string { return c.Healthy(destination).Endpoints }
+	waitFor(t, "the unreachable endpoint to go down", func() bool { return len(healthy()) == 1 })
+	if healthy()[0] != up {
+		t.Errorf("Expected only %s to be healthy, got: %v", up, healthy())
+	}
+
+	atomic.StoreInt32(&failing, 1)
+	waitFor(t, "the failing endpoint to go down", func() bool { return len(healthy()) == 0 })
+	atomic.StoreInt32(&failing, 0)
+	waitFor(t, "the endpoint to recover", func() bool { return len(healthy()) == 1 })
+
+	statuses := c.Statuses()
+	if len(statuses) != 2 || statuses[0].Up == statuses[1].Up {
+		t.Errorf("Expected one endpoint up and one down, got: %+v", statuses)
+	}
+}
+
+func TestHealthCheckerTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := l.Addr().String()
+	route := &resolver.Route{Name: "db", Host: "db", HealthCheck: &resolver.HealthCheck{
+		Type:               "tcp",
+		Interval:           10 * time.Millisecond,
+		UnhealthyThreshold: 1,
+	}}
+	destination := resolver.Destination{Route: route, HostPort: endpoint, Endpoints: []string{endpoint}}
+
+	c := &HealthChecker{}
+	c.sync([]resolver.Destination{destination})
+	defer c.sync(nil)
+	waitFor(t, "the endpoint to be checked", func() bool {
+		statuses := c.Statuses()
+		return len(statuses) == 1 && !statuses[0].CheckedAt.IsZero()
+	})
+	if len(c.Healthy(destination).Endpoints) != 1 {
+		t.Errorf("A listening endpoint should be up")
+	}
+
+	l.Close()
+	waitFor(t, "the closed endpoint to go down", func() bool { return len(c.Healthy(destination).Endpoints) == 0 })
+
+	c.sync(nil)
+	if statuses := c.Statuses(); len(statuses) != 0 {
+		t.Errorf("Endpoints no longer routed to should not be checked, got: %+v", statuses)
+	}
+}
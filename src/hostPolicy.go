@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// HostPolicy decides which hosts get a certificate, requested from the ACME
+// server or issued by the local CA: the hosts listed, and the hosts the
+// active resolver routes. When Domains is set, routed hosts must be one of
+// them or a subdomain, so a catch-all route cannot make the gateway request
+// certificates for any name pointed at it.
+type HostPolicy struct {
+	Proxy   *ProxyServer
+	Hosts   []string
+	Domains []string
+}
+
+// Allow returns an error for the hosts not to get a certificate.
+func (p *HostPolicy) Allow(host string) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range p.Hosts {
+		if host == strings.ToLower(allowed) {
+			return nil
+		}
+	}
+	if !p.inDomains(host) {
+		return errors.New("Host(" + host + ") is outside of the allowed domains")
+	}
+	if !p.Proxy.Routable(host) {
+		return errors.New("Unkown host(" + host + ")")
+	}
+	return nil
+}
+
+func (p *HostPolicy) inDomains(host string) bool {
+	if len(p.Domains) == 0 {
+		return true
+	}
+	for _, domain := range p.Domains {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Candidates returns the hosts of the routes the policy allows, with the
+// listed hosts: the hosts certificates are expected for.
+func (p *HostPolicy) Candidates() []string {
+	seen := map[string]bool{}
+	hosts := []string{}
+	add := func(host string) {
+		if host != "" && !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	for _, host := range p.Hosts {
+		add(host)
+	}
+	for _, destination := range p.Proxy.Destinations() {
+		if destination.Route != nil && p.Allow(destination.Route.Host) == nil {
+			add(destination.Route.Host)
+		}
+	}
+	return hosts
+}
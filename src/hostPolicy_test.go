@@ -0,0 +1,42 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"gateway/resolver"
+)
+
+func TestHostPolicy(t *testing.T) {
+	subnet := &resolver.Subnet{}
+	subnet.SetRoutes(append(resolver.ParseProxyMappings("api:api-server:80"), resolver.Route{Name: "shop", Host: "shop.example.test", Destination: "shop", Port: 80}))
+	policy := &HostPolicy{Proxy: &ProxyServer{destinationResolver: subnet}, Hosts: []string{"status.example.com"}}
+
+	for host, allowed := range map[string]bool{
+		"shop.example.test":          true,
+		"api.mystack.local.example":  true,
+		"Status.Example.com.":        true,
+		"unknown.example.test":       false,
+		"apis.mystack.local.example": false,
+	} {
+		if err := policy.Allow(host); (err == nil) != allowed {
+			t.Errorf("Expected %s to be allowed: %v (%v)", host, allowed, err)
+		}
+	}
+
+	policy.Domains = []string{"local.example", ".example.com"}
+	if policy.Allow("api.mystack.local.example") != nil || policy.Allow("shop.example.test") == nil {
+		t.Error("Expected routed hosts outside of the domains to be refused")
+	}
+	if policy.Allow("status.example.com") != nil {
+		t.Error("Expected listed hosts to be allowed whatever their domain")
+	}
+
+	policy.Domains = nil
+	candidates := policy.Candidates()
+	sort.Strings(candidates)
+	if !reflect.DeepEqual(candidates, []string{"api", "shop.example.test", "status.example.com"}) {
+		t.Errorf("Unexpected candidates %v", candidates)
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"gateway/resolver"
+)
+
+// Exchange is a single request/response pair captured by the inspector.
+type Exchange struct {
+	ID          uint64        `json:"id"`
+	RequestID   string        `json:"requestId,omitempty"`
+	StartedAt   time.Time     `json:"startedAt"`
+	Duration    time.Duration `json:"duration"`
+	Method      string        `json:"method"`
+	Scheme      string        `json:"scheme"`
+	Host        string        `json:"host"`
+	URL         string        `json:"url"`
+	Proto       string        `json:"proto"`
+	RemoteAddr  string        `json:"remoteAddr"`
+	Destination string        `json:"destination"`
+	Route       string        `json:"route,omitempty"`
+	Stack       string        `json:"stack,omitempty"`
+	Websocket   bool          `json:"websocket"`
+	Status      int           `json:"status"`
+
+	RequestHeader        http.Header `json:"requestHeader,omitempty"`
+	RequestBody          string      `json:"requestBody,omitempty"`
+	RequestBodySize      int64       `json:"requestBodySize"`
+	RequestBodyTruncated bool        `json:"requestBodyTruncated,omitempty"`
+
+	ResponseHeader        http.Header `json:"responseHeader,omitempty"`
+	ResponseBody          string      `json:"responseBody,omitempty"`
+	ResponseBodySize      int64       `json:"responseBodySize"`
+	ResponseBodyTruncated bool        `json:"responseBodyTruncated,omitempty"`
+}
+
+// summary returns a copy of the exchange without headers and bodies, which is
+// what the listing endpoint serves.
+func (e *Exchange) summary() Exchange {
+	s := *e
+	s.RequestHeader, s.RequestBody = nil, ""
+	s.ResponseHeader, s.ResponseBody = nil, ""
+	return s
+}
+
+// Inspector records the traffic flowing through the proxy handler into a
+// bounded ring buffer and serves it as a web UI and JSON API on its own port.
+type Inspector struct {
+	Capacity  int
+	BodyLimit int64
+	// Health and Breakers are served on /api/health and /api/breakers when
+	// set
+	Health   *HealthChecker
+	Breakers *CircuitBreakers
+	// Deployments are served on /api/deployments when set. They are only
+	// moved between stacks through the admin API, the inspector has no
+	// authentication.
+	Deployments resolver.DeploymentManager
+	// CA is the local CA, whose root certificate is served on /ca.crt when
+	// set
+	CA *LocalCA
+
+	handler   http.HandlerFunc
+	mu        sync.RWMutex
+	exchanges []*Exchange
+	next      int
+	lastID    uint64
+}
+
+func (i *Inspector) add(e *Exchange) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.exchanges == nil {
+		if i.Capacity < 1 {
+			i.Capacity = 1
+		}
+		i.exchanges = make([]*Exchange, 0, i.Capacity)
+	}
+	i.lastID++
+	e.ID = i.lastID
+	if len(i.exchanges) < i.Capacity {
+		i.exchanges = append(i.exchanges, e)
+		return
+	}
+	i.exchanges[i.next] = e
+	i.next = (i.next + 1) % i.Capacity
+}
+
+// Exchanges returns the recorded exchanges, newest first.
+func (i *Inspector) Exchanges() []*Exchange {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	exchanges := make([]*Exchange, 0, len(i.exchanges))
+	for n := len(i.exchanges) - 1; n >= 0; n-- {
+		exchanges = append(exchanges, i.exchanges[(i.next+n)%len(i.exchanges)])
+	}
+	return exchanges
+}
+
+// Exchange returns the recorded exchange with the given id, if it is still
+// in the buffer.
+func (i *Inspector) Exchange(id uint64) (*Exchange, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	for _, e := range i.exchanges {
+		if e.ID == id {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+func (i *Inspector) clear() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.exchanges = i.exchanges[:0]
+	i.next = 0
+}
+
+// Wrap returns a handler recording every exchange handled by h. Captured
+// requests are replayed through h as well.
+func (i *Inspector) Wrap(h http.HandlerFunc) http.HandlerFunc {
+	i.handler = h
+	return func(w http.ResponseWriter, r *http.Request) {
+		i.record(h, w, r)
+	}
+}
+
+func (i *Inspector) record(h http.HandlerFunc, w http.ResponseWriter, r *http.Request) *Exchange {
+	r, info := withRequestInfo(r)
+	e := &Exchange{
+		StartedAt:     time.Now(),
+		Method:        r.Method,
+		Scheme:        "http",
+		Host:          r.Host,
+		URL:           r.URL.RequestURI(),
+		Proto:         r.Proto,
+		RemoteAddr:    r.RemoteAddr,
+		RequestHeader: r.Header.Clone(),
+	}
+	if r.TLS != nil {
+		e.Scheme = "https"
+	}
+
+	reqBody := &captureBuffer{limit: i.BodyLimit}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, reqBody), r.Body}
+	}
+	rw := &recordingResponseWriter{ResponseWriter: w, body: &captureBuffer{limit: i.BodyLimit}}
+
+	h(rw, r)
+
+	e.Duration = time.Since(e.StartedAt)
+	e.Destination = info.Destination
+	e.Route = info.Route
+	e.RequestID = info.RequestID
+	e.Stack = info.Stack
+	e.Websocket = rw.hijacked
+	e.Status = rw.statusCode()
+	e.RequestBody, e.RequestBodySize, e.RequestBodyTruncated = reqBody.String(), reqBody.size, reqBody.truncated()
+	e.ResponseHeader = rw.Header().Clone()
+	e.ResponseBody, e.ResponseBodySize, e.ResponseBodyTruncated = rw.body.String(), rw.body.size, rw.body.truncated()
+	i.add(e)
+	return e
+}
+
+// ListenAndServe serves the inspector UI and API on the given port.
+func (i *Inspector) ListenAndServe(port int64) error {
+	fmt.Println("gatway inspector listening on port", port)
+	return http.ListenAndServe(fmt.Sprintf(":%d", port), i.ServeMux())
+}
+
+// ServeMux returns the inspector's UI and API routes.
+func (i *Inspector) ServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", i.handleUI)
+	mux.HandleFunc("/api/exchanges", i.handleExchanges)
+	mux.HandleFunc("/api/exchanges/", i.handleExchange)
+	mux.HandleFunc("/api/har", i.handleHAR)
+	mux.Handle("/metrics", promhttp.Handler())
+	if i.Health != nil {
+		mux.HandleFunc("/api/health", i.Health.handleHealth)
+	}
+	if i.Breakers != nil {
+		mux.HandleFunc("/api/breakers", i.Breakers.handleBreakers)
+	}
+	if i.Deployments != nil {
+		mux.HandleFunc("/api/deployments", deploymentsStatusHandler(i.Deployments))
+	}
+	if i.CA != nil {
+		mux.HandleFunc("/ca.crt", i.CA.handleRootCertificate)
+	}
+	return mux
+}
+
+func (i *Inspector) handleUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, inspectorPage)
+}
+
+func (i *Inspector) handleExchanges(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "DELETE":
+		i.clear()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	summaries := []Exchange{}
+	for _, e := range i.filter(r.URL.Query()) {
+		summaries = append(summaries, e.summary())
+	}
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+// filter selects recorded exchanges, newest first, by the query parameters
+// shared by the listing and HAR endpoints: a host substring, a status (404) or
+// status class (5xx), a route substring, a comma separated list of ids and a limit.
+func (i *Inspector) filter(query url.Values) []*Exchange {
+	host, status, route := query.Get("host"), query.Get("status"), query.Get("route")
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	var ids map[uint64]bool
+	if query.Get("ids") != "" {
+		ids = map[uint64]bool{}
+		for _, field := range strings.Split(query.Get("ids"), ",") {
+			if id, err := strconv.ParseUint(strings.TrimSpace(field), 10, 64); err == nil {
+				ids[id] = true
+			}
+		}
+	}
+
+	exchanges := []*Exchange{}
+	for _, e := range i.Exchanges() {
+		if host != "" && !strings.Contains(e.Host, host) {
+			continue
+		}
+		if status != "" && !statusMatches(e.Status, status) {
+			continue
+		}
+		if route != "" && !strings.Contains(e.Route, route) {
+			continue
+		}
+		if ids != nil && !ids[e.ID] {
+			continue
+		}
+		exchanges = append(exchanges, e)
+		if limit > 0 && len(exchanges) == limit {
+			break
+		}
+	}
+	return exchanges
+}
+
+// statusMatches tells whether the status is the one given, or in the class
+// given as 4xx.
+func statusMatches(status int, filter string) bool {
+	code := strconv.Itoa(status)
+	if len(filter) == 3 && strings.HasSuffix(strings.ToLower(filter), "xx") {
+		return code[:1] == filter[:1]
+	}
+	return code == filter
+}
+
+func (i *Inspector) handleExchange(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/exchanges/"), "/")
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil || len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+	e, ok := i.Exchange(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 2 {
+		if parts[1] != "replay" {
+			http.NotFound(w, r)
+			return
+		}
+		i.handleReplay(w, r, e)
+		return
+	}
+	writeJSON(w, http.StatusOK, e)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+	}
+}
+
+// captureBuffer keeps the first limit bytes written to it and counts the rest.
+type captureBuffer struct {
+	limit int64
+	size  int64
+	data  []byte
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - int64(len(b.data)); room > 0 {
+		if int64(len(p)) < room {
+			room = int64(len(p))
+		}
+		b.data = append(b.data, p[:room]...)
+	}
+	b.size += int64(len(p))
+	return len(p), nil
+}
+
+func (b *captureBuffer) String() string {
+	return string(b.data)
+}
+
+func (b *captureBuffer) truncated() bool {
+	return b.size > int64(len(b.data))
+}
+
+// recordingResponseWriter remembers the status and a copy of the body written
+// through it, while still supporting websocket hijacking and streaming.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status   int
+	body     *captureBuffer
+	hijacked bool
+}
+
+// statusCode returns the status sent to the client: 200 when the handler
+// wrote the body without a status, 101 when it took the connection over for
+// a websocket.
+func (w *recordingResponseWriter) statusCode() int {
+	if w.status != 0 {
+		return w.status
+	}
+	if w.hijacked {
+		return http.StatusSwitchingProtocols
+	}
+	return http.StatusOK
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *recordingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	w.hijacked = true
+	return hj.Hijack()
+}
@@ -0,0 +1,204 @@
+package main
+
+// inspectorPage is the single page web UI served by the inspector. It only
+// talks to the JSON API, so everything it shows is also available to scripts.
+const inspectorPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Gateway inspector</title>
+<style>
+body { margin: 0; font: 13px/1.4 -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; color: #222; }
+header { display: flex; gap: 8px; align-items: center; padding: 8px 12px; background: #263238; color: #fff; }
+header h1 { font-size: 15px; margin: 0 12px 0 0; }
+header input { flex: 1; padding: 4px 6px; }
+header a { color: #fff; }
+main { display: flex; height: calc(100vh - 44px); }
+#list { width: 55%; overflow: auto; border-right: 1px solid #ccc; }
+#detail { flex: 1; overflow: auto; padding: 8px 12px; }
+table { width: 100%; border-collapse: collapse; }
+th, td { text-align: left; padding: 3px 6px; border-bottom: 1px solid #eee; white-space: nowrap; }
+td.url { max-width: 320px; overflow: hidden; text-overflow: ellipsis; }
+tr.row { cursor: pointer; }
+tr.row:hover { background: #f3f6f8; }
+tr.selected { background: #e1ecf4; }
+.s2 { color: #2e7d32; } .s3 { color: #1565c0; } .s4 { color: #ef6c00; } .s5 { color: #c62828; }
+pre { background: #f6f8fa; padding: 6px; white-space: pre-wrap; word-break: break-all; }
+h2 { font-size: 14px; margin: 12px 0 4px; }
+.muted { color: #888; }
+textarea { width: 100%; height: 200px; font: 12px monospace; }
+</style>
+</head>
+<body>
+<header>
+<h1>Gateway inspector</h1>
+<input id="filter" placeholder="Filter by host">
+<label><input id="live" type="checkbox" checked> live</label>
+<button id="health">Health</button>
+<button id="har">Download HAR</button>
+<button id="clear">Clear</button>
+<a id="ca" href="ca.crt" hidden>Root CA</a>
+</header>
+<main>
+<div id="list"><table>
+<thead><tr><th>#</th><th>Time</th><th>Method</th><th>Host</th><th>URL</th><th>Destination</th><th>Status</th><th>Duration</th><th>Size</th></tr></thead>
+<tbody id="rows"></tbody>
+</table></div>
+<div id="detail"><p class="muted">Select a request to see its details.</p></div>
+</main>
+<script>
+var selected = null;
+
+function esc(s) {
+	return String(s == null ? "" : s).replace(/[&<>"]/g, function (c) {
+		return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;"}[c];
+	});
+}
+function ms(d) { return (d / 1e6).toFixed(1) + " ms"; }
+function headers(h) {
+	return Object.keys(h || {}).sort().map(function (k) {
+		return h[k].map(function (v) { return esc(k) + ": " + esc(v); }).join("\n");
+	}).join("\n");
+}
+function body(text, size, truncated) {
+	if (!size) { return '<p class="muted">empty</p>'; }
+	return "<pre>" + esc(text) + "</pre>" + (truncated ? '<p class="muted">truncated, ' + size + " bytes in total</p>" : "");
+}
+
+function refresh() {
+	var url = "api/exchanges?limit=500&host=" + encodeURIComponent(document.getElementById("filter").value);
+	fetch(url).then(function (r) { return r.json(); }).then(function (exchanges) {
+		document.getElementById("rows").innerHTML = exchanges.map(function (e) {
+			return '<tr class="row' + (e.id === selected ? " selected" : "") + '" data-id="' + e.id + '">' +
+				"<td>" + e.id + "</td>" +
+				"<td>" + new Date(e.startedAt).toLocaleTimeString() + "</td>" +
+				"<td>" + esc(e.method) + (e.websocket ? " (ws)" : "") + "</td>" +
+				"<td>" + esc(e.host) + "</td>" +
+				'<td class="url">' + esc(e.url) + "</td>" +
+				"<td>" + esc(e.destination) + "</td>" +
+				'<td class="s' + String(e.status)[0] + '">' + e.status + "</td>" +
+				"<td>" + ms(e.duration) + "</td>" +
+				"<td>" + e.responseBodySize + "</td></tr>";
+		}).join("");
+	});
+}
+
+function show(id) {
+	selected = id;
+	fetch("api/exchanges/" + id).then(function (r) { return r.json(); }).then(function (e) {
+		document.getElementById("detail").innerHTML =
+			"<h2>" + esc(e.method) + " " + esc(e.host) + esc(e.url) + "</h2>" +
+			'<p><button id="replay">Replay</button> <button id="edit">Edit &amp; replay</button> ' +
+			'<a href="api/har?ids=' + e.id + '">HAR</a></p>' +
+			'<div id="editor" hidden><textarea id="edits"></textarea><button id="send">Send</button></div>' +
+			"<p>" + esc(e.proto) + " from " + esc(e.remoteAddr) + " to <b>" + esc(e.destination || "unresolved") + "</b>" +
+				(e.route ? " by route <code>" + esc(e.route) + "</code>" : "") +
+				(e.stack ? " on stack <b>" + esc(e.stack) + "</b>" : "") + ", " +
+			e.status + " in " + ms(e.duration) + "</p>" +
+			(e.requestId ? '<p class="muted">Request ID <code>' + esc(e.requestId) + "</code></p>" : "") +
+			"<h2>Request headers</h2><pre>" + headers(e.requestHeader) + "</pre>" +
+			"<h2>Request body</h2>" + body(e.requestBody, e.requestBodySize, e.requestBodyTruncated) +
+			"<h2>Response headers</h2><pre>" + headers(e.responseHeader) + "</pre>" +
+			"<h2>Response body</h2>" + body(e.responseBody, e.responseBodySize, e.responseBodyTruncated);
+		document.getElementById("edits").value = JSON.stringify({
+			method: e.method, url: e.url, header: e.requestHeader || {}, body: e.requestBody || ""
+		}, null, 2);
+		document.getElementById("replay").onclick = function () { replay(e.id, ""); };
+		document.getElementById("edit").onclick = function () {
+			document.getElementById("editor").hidden = false;
+		};
+		document.getElementById("send").onclick = function () {
+			replay(e.id, document.getElementById("edits").value);
+		};
+	});
+	refresh();
+}
+
+function health() {
+	selected = null;
+	fetch("api/health").then(function (r) {
+		if (!r.ok) { return []; }
+		return r.json();
+	}).then(function (statuses) {
+		document.getElementById("detail").innerHTML = "<h2>Endpoint health</h2>" + (statuses.length === 0 ?
+			'<p class="muted">No route has a health check.</p>' :
+			"<table><thead><tr><th>Route</th><th>Endpoint</th><th>Check</th><th>State</th><th>Since</th><th>Error</th></tr></thead><tbody>" +
+			statuses.map(function (s) {
+				return "<tr><td>" + esc(s.route) + "</td><td>" + esc(s.endpoint) + "</td>" +
+					"<td>" + esc(s.type) + " " + esc(s.path) + "</td>" +
+					'<td class="' + (s.up ? "s2" : "s5") + '">' + (s.up ? "up" : "down") + "</td>" +
+					"<td>" + new Date(s.since).toLocaleTimeString() + "</td>" +
+					"<td>" + esc(s.lastError) + "</td></tr>";
+			}).join("") + "</tbody></table>") + '<div id="breakers"></div><div id="deployments"></div>';
+		breakers();
+		deployments();
+	});
+	refresh();
+}
+
+function breakers() {
+	fetch("api/breakers").then(function (r) {
+		if (!r.ok) { return []; }
+		return r.json();
+	}).then(function (statuses) {
+		document.getElementById("breakers").innerHTML = "<h2>Circuit breakers</h2>" + (statuses.length === 0 ?
+			'<p class="muted">No request proxied yet.</p>' :
+			"<table><thead><tr><th>Endpoint</th><th>State</th><th>Failures in a row</th><th>Error rate</th><th>Trips</th></tr></thead><tbody>" +
+			statuses.map(function (s) {
+				return "<tr><td>" + esc(s.endpoint) + "</td>" +
+					'<td class="' + (s.state === "closed" ? "s2" : "s5") + '">' + esc(s.state) + "</td>" +
+					"<td>" + s.consecutiveFailures + "</td><td>" + Math.round(s.errorRate * 100) + "%</td>" +
+					"<td>" + s.trips + "</td></tr>";
+			}).join("") + "</tbody></table>");
+	});
+}
+
+function deployments() {
+	fetch("api/deployments").then(function (r) {
+		if (!r.ok) { return []; }
+		return r.json();
+	}).then(function (statuses) {
+		if (statuses.length === 0) { return; }
+		document.getElementById("deployments").innerHTML = "<h2>Deployments</h2>" +
+			"<table><thead><tr><th>Deployment</th><th>Stack</th><th>Created</th><th>State</th><th>Weight</th></tr></thead><tbody>" +
+			statuses.map(function (d) {
+				return d.stacks.map(function (s) {
+					return "<tr><td>" + esc(d.name) + (d.pinned ? " (pinned)" : "") + "</td><td>" + esc(s.name) + "</td>" +
+						"<td>" + new Date(s.createdAt).toLocaleString() + "</td>" +
+						'<td class="' + (s.healthy ? "s2" : "s5") + '">' + (s.healthy ? "healthy" : "unhealthy") + "</td>" +
+						"<td>" + s.weight + "%</td></tr>";
+				}).join("");
+			}).join("") + "</tbody></table>";
+	});
+}
+
+function replay(id, edits) {
+	fetch("api/exchanges/" + id + "/replay", {method: "POST", body: edits}).then(function (r) {
+		if (!r.ok) { return r.text().then(function (t) { alert(t); }); }
+		return r.json().then(function (e) { show(e.id); });
+	});
+}
+
+document.getElementById("rows").addEventListener("click", function (ev) {
+	var row = ev.target.closest("tr.row");
+	if (row) { show(Number(row.dataset.id)); }
+});
+document.getElementById("filter").addEventListener("input", refresh);
+document.getElementById("health").addEventListener("click", health);
+document.getElementById("har").addEventListener("click", function () {
+	location.href = "api/har?host=" + encodeURIComponent(document.getElementById("filter").value);
+});
+document.getElementById("clear").addEventListener("click", function () {
+	fetch("api/exchanges", {method: "DELETE"}).then(refresh);
+});
+fetch("ca.crt", {method: "HEAD"}).then(function (r) {
+	document.getElementById("ca").hidden = !r.ok;
+});
+setInterval(function () {
+	if (document.getElementById("live").checked) { refresh(); }
+}, 2000);
+refresh();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInspectorRecording(t *testing.T) {
+	inspector := &Inspector{Capacity: 3, BodyLimit: 4}
+	handler := inspector.Wrap(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		info := requestInfo(r)
+		info.Route = "shop -> shop:80"
+		if strings.HasPrefix(r.Host, "api") {
+			info.Route = "api -> api:80"
+		}
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(body)
+	})
+	send := func(host, path, body string) {
+		handler(httptest.NewRecorder(), httptest.NewRequest("POST", "http://"+host+path, strings.NewReader(body)))
+	}
+	list := func(query string) []Exchange {
+		w := httptest.NewRecorder()
+		inspector.ServeMux().ServeHTTP(w, httptest.NewRequest("GET", "/api/exchanges"+query, nil))
+		exchanges := []Exchange{}
+		if err := json.Unmarshal(w.Body.Bytes(), &exchanges); err != nil {
+			t.Fatalf("Unexpected listing %s: %v", w.Body, err)
+		}
+		return exchanges
+	}
+	ids := func(exchanges []Exchange) string {
+		ids := []string{}
+		for _, e := range exchanges {
+			ids = append(ids, fmt.Sprint(e.ID))
+		}
+		return strings.Join(ids, ",")
+	}
+
+	for n := 1; n <= 4; n++ {
+		send("shop", "/", fmt.Sprint(n))
+	}
+	if got := ids(list("")); got != "4,3,2" {
+		t.Errorf("Expected the oldest exchange to be evicted, newest first, got %s", got)
+	}
+
+	send("api.example", "/missing", "")
+	send("shop", "/", "truncated")
+	for query, expected := range map[string]string{
+		"?host=api":          "5",
+		"?status=404":        "5",
+		"?status=4xx":        "5",
+		"?status=200":        "6,4",
+		"?route=shop":        "6,4",
+		"?route=api&host=sh": "",
+		"?limit=1":           "6",
+	} {
+		if got := ids(list(query)); got != expected {
+			t.Errorf("Expected %s to select %q, got %q", query, expected, got)
+		}
+	}
+
+	e, _ := inspector.Exchange(6)
+	if e.RequestBody != "trun" || !e.RequestBodyTruncated || e.RequestBodySize != 9 {
+		t.Errorf("Expected the request body cut at 4 bytes, got %q (%d bytes)", e.RequestBody, e.RequestBodySize)
+	}
+	if e.ResponseBody != "trun" || !e.ResponseBodyTruncated || e.ResponseBodySize != 9 {
+		t.Errorf("Expected the response body cut at 4 bytes, got %q (%d bytes)", e.ResponseBody, e.ResponseBodySize)
+	}
+
+	w := httptest.NewRecorder()
+	inspector.ServeMux().ServeHTTP(w, httptest.NewRequest("DELETE", "/api/exchanges", nil))
+	if w.Code != http.StatusNoContent || len(list("")) != 0 {
+		t.Errorf("Expected the exchanges to be cleared, got %d", w.Code)
+	}
+	send("shop", "/", "")
+	if got := ids(list("")); got != "7" {
+		t.Errorf("Expected recording to go on after clearing, got %s", got)
+	}
+}
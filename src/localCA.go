@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLS modes
+const (
+	acmeMode    = "acme"
+	localCAMode = "local-ca"
+)
+
+func validTLSMode(mode string) error {
+	switch mode {
+	case acmeMode, localCAMode:
+		return nil
+	}
+	return fmt.Errorf("Unknown TLS mode '%s' (%s, %s)", mode, acmeMode, localCAMode)
+}
+
+// LocalCA is a certificate authority for development stacks, whose hostnames
+// Let's Encrypt cannot validate. Its root certificate and key are kept in Dir
+// (ca.crt and ca.key), generated the first time, so developers only need to
+// trust the root once. Certificates are issued on the fly for the hosts
+// HostPolicy accepts, and kept in memory until they are close to expiring.
+type LocalCA struct {
+	Dir        string
+	HostPolicy func(host string) error
+	// Domains limits the names the root can sign for, when set, so trusting
+	// it does not let anyone holding its key impersonate any site. The
+	// constraints are set when the root is generated.
+	Domains []string
+	// ValidFor is how long issued certificates are valid
+	ValidFor time.Duration
+
+	mu      sync.Mutex
+	root    *x509.Certificate
+	rootPEM []byte
+	key     crypto.Signer
+	issued  map[string]*tls.Certificate
+	// issuing holds a channel per host being issued for, closed when done, so
+	// concurrent handshakes wait for the same certificate
+	issuing map[string]chan struct{}
+	// maxIssued bounds the certificates kept, localCAMaxIssued when 0; the
+	// tests lower it
+	maxIssued int
+}
+
+// localCAMaxIssued is how many certificates the local CA keeps in memory
+const localCAMaxIssued = 1024
+
+// Load reads the root certificate and key from Dir, and generates them when
+// there are none yet.
+func (ca *LocalCA) Load() error {
+	certPath, keyPath := filepath.Join(ca.Dir, "ca.crt"), filepath.Join(ca.Dir, "ca.key")
+	if _, err := os.Stat(certPath); os.IsNotExist(err) {
+		if err := ca.generate(certPath, keyPath); err != nil {
+			return fmt.Errorf("Unable to create the local CA: %v", err)
+		}
+		log.Printf("Created local CA %s, trust it to browse the gateway over https", certPath)
+	}
+
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return fmt.Errorf("Unable to load the local CA: %v", err)
+	}
+	root, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("Unable to load the local CA: %v", err)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok || !root.IsCA {
+		return fmt.Errorf("Unable to load the local CA: %s is not a CA certificate", certPath)
+	}
+	if len(ca.Domains) > 0 && len(root.PermittedDNSDomains) == 0 {
+		log.Printf("Local CA %s can sign for any domain, remove it to create one limited to %s", certPath, strings.Join(ca.Domains, ", "))
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.root, ca.key, ca.issued = root, key, map[string]*tls.Certificate{}
+	ca.rootPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw})
+	return nil
+}
+
+func (ca *LocalCA) generate(certPath, keyPath string) error {
+	if err := os.MkdirAll(ca.Dir, 0700); err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "Gateway development CA " + hostname, Organization: []string{"Gateway development CA"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	ca.constrain(template)
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// constrain limits the root to the domains, and the ip addresses among them.
+// Other ip addresses are excluded, the policy only accepts the listed ones.
+func (ca *LocalCA) constrain(template *x509.Certificate) {
+	if len(ca.Domains) == 0 {
+		return
+	}
+	template.PermittedDNSDomainsCritical = true
+	for _, domain := range ca.Domains {
+		if ip := net.ParseIP(domain); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			template.PermittedIPRanges = append(template.PermittedIPRanges, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		if domain = strings.ToLower(strings.Trim(domain, ".")); domain != "" {
+			template.PermittedDNSDomains = append(template.PermittedDNSDomains, domain)
+		}
+	}
+	if len(template.PermittedIPRanges) == 0 {
+		template.ExcludedIPRanges = []*net.IPNet{
+			{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+			{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+		}
+	}
+}
+
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial
+}
+
+// GetCertificate is the tls.Config callback issuing the certificate of the
+// server name, or reusing the one issued before.
+func (ca *LocalCA) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if host == "" {
+		return nil, errors.New("No server name to issue a certificate for")
+	}
+	ca.mu.Lock()
+	for {
+		cert, found := ca.issued[host]
+		// certificates are renewed once two thirds of their validity are over
+		if found && time.Now().Before(cert.Leaf.NotAfter.Add(-ca.validFor()/3)) {
+			ca.mu.Unlock()
+			return cert, nil
+		}
+		wait, issuing := ca.issuing[host]
+		if !issuing {
+			break
+		}
+		ca.mu.Unlock()
+		<-wait
+		ca.mu.Lock()
+	}
+	root, key := ca.root, ca.key
+	done := make(chan struct{})
+	if ca.issuing == nil {
+		ca.issuing = map[string]chan struct{}{}
+	}
+	ca.issuing[host] = done
+	ca.mu.Unlock()
+
+	// the lock is not held while issuing, so handshakes of other hosts do
+	// not wait on the policy and signing
+	var cert *tls.Certificate
+	var err error
+	if ca.HostPolicy != nil {
+		err = ca.HostPolicy(host)
+	}
+	if err == nil {
+		cert, err = ca.issue(host, root, key)
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	delete(ca.issuing, host)
+	close(done)
+	if err != nil {
+		return nil, err
+	}
+	ca.keep(host, cert)
+	return cert, nil
+}
+
+// keep caches the certificate of the host, making room by dropping the one
+// that expires first once there are maxIssued of them. The lock is held.
+func (ca *LocalCA) keep(host string, cert *tls.Certificate) {
+	limit := ca.maxIssued
+	if limit <= 0 {
+		limit = localCAMaxIssued
+	}
+	if _, found := ca.issued[host]; !found && len(ca.issued) >= limit {
+		oldest := ""
+		for name, issued := range ca.issued {
+			if oldest == "" || issued.Leaf.NotAfter.Before(ca.issued[oldest].Leaf.NotAfter) {
+				oldest = name
+			}
+		}
+		delete(ca.issued, oldest)
+	}
+	ca.issued[host] = cert
+}
+
+func (ca *LocalCA) validFor() time.Duration {
+	if ca.ValidFor <= 0 {
+		return 90 * 24 * time.Hour
+	}
+	return ca.ValidFor
+}
+
+func (ca *LocalCA) issue(host string, root *x509.Certificate, signer crypto.Signer) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(ca.validFor()),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, root, &key.PublicKey, signer)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to issue a certificate for %s: %v", host, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Local CA issued a certificate for %s", host)
+	return &tls.Certificate{Certificate: [][]byte{der, root.Raw}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// Statuses reports the certificates issued so far.
+func (ca *LocalCA) Statuses(now time.Time) []CertificateStatus {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	statuses := []CertificateStatus{}
+	for host, cert := range ca.issued {
+		status := CertificateStatus{
+			Host:      host,
+			Status:    "valid",
+			Source:    localCAMode,
+			Issuer:    cert.Leaf.Issuer.CommonName,
+			NotBefore: cert.Leaf.NotBefore,
+			NotAfter:  cert.Leaf.NotAfter,
+		}
+		if now.After(cert.Leaf.NotAfter) {
+			status.Status = "expired"
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Host < statuses[j].Host })
+	return statuses
+}
+
+// handleRootCertificate serves the root certificate for developers to trust.
+func (ca *LocalCA) handleRootCertificate(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	rootPEM := ca.rootPEM
+	ca.mu.Unlock()
+	w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+	w.Header().Set("Content-Disposition", `attachment; filename="gateway-ca.crt"`)
+	w.Write(rootPEM)
+}
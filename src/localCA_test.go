@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLocalCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	policy := func(host string) error {
+		if host == "api.mystack.local.example" {
+			return nil
+		}
+		return errors.New("Unkown host(" + host + ")")
+	}
+	ca := &LocalCA{Dir: filepath.Join(dir, "ca"), HostPolicy: policy}
+	if err := ca.Load(); err != nil {
+		t.Fatal(err)
+	}
+	generated := ca.root.SerialNumber
+	if err := ca.Load(); err != nil || ca.root.SerialNumber.Cmp(generated) != 0 {
+		t.Fatalf("Expected the root to be kept in the directory (%v)", err)
+	}
+
+	cert, err := ca.GetCertificate(&tls.ClientHelloInfo{ServerName: "API.mystack.local.example."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.root)
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: "api.mystack.local.example", Roots: roots}); err != nil {
+		t.Errorf("Expected the certificate to chain to the root: %v", err)
+	}
+	if again, _ := ca.GetCertificate(&tls.ClientHelloInfo{ServerName: "api.mystack.local.example"}); again != cert {
+		t.Error("Expected the issued certificate to be reused")
+	}
+	if _, err := ca.GetCertificate(&tls.ClientHelloInfo{ServerName: "elsewhere.example.com"}); err == nil {
+		t.Error("Expected no certificate for a host that is not routed")
+	}
+	if statuses := ca.Statuses(cert.Leaf.NotBefore); len(statuses) != 1 || statuses[0].Source != localCAMode {
+		t.Errorf("Expected the issued certificate in the statuses, got %+v", statuses)
+	}
+
+	inspector := &Inspector{CA: ca}
+	w := httptest.NewRecorder()
+	inspector.ServeMux().ServeHTTP(w, httptest.NewRequest("GET", "/ca.crt", nil))
+	if saved, _ := ioutil.ReadFile(filepath.Join(dir, "ca", "ca.crt")); w.Code != 200 || w.Body.String() != string(saved) {
+		t.Errorf("Expected the inspector to serve the root certificate, got %d", w.Code)
+	}
+}
+
+func TestLocalCADomains(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blocked, release := make(chan bool), make(chan bool)
+	policy := func(host string) error {
+		if host == "slow.local.example" {
+			blocked <- true
+			<-release
+		}
+		return nil
+	}
+	ca := &LocalCA{Dir: dir, HostPolicy: policy, Domains: []string{"local.example", ".status.example.com"}}
+	if err := ca.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ca.root.PermittedDNSDomains, []string{"local.example", "status.example.com"}) || len(ca.root.ExcludedIPRanges) != 2 {
+		t.Fatalf("Expected the root to be limited to the domains, got %v and %v", ca.root.PermittedDNSDomains, ca.root.ExcludedIPRanges)
+	}
+
+	// the policy of one host does not hold up the handshakes of others
+	go ca.GetCertificate(&tls.ClientHelloInfo{ServerName: "slow.local.example"})
+	<-blocked
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.root)
+	for host, valid := range map[string]bool{
+		"api.mystack.local.example": true,
+		"status.example.com":        true,
+		"elsewhere.example.com":     false,
+		"127.0.0.1":                 false,
+	} {
+		cert, err := ca.GetCertificate(&tls.ClientHelloInfo{ServerName: host})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); (err == nil) != valid {
+			t.Errorf("Expected the certificate of %s to be valid: %v (%v)", host, valid, err)
+		}
+	}
+	close(release)
+}
+
+func TestLocalCAIssuesOncePerHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var mu sync.Mutex
+	checked := map[string]int{}
+	release := make(chan struct{})
+	policy := func(host string) error {
+		mu.Lock()
+		checked[host]++
+		mu.Unlock()
+		<-release
+		return nil
+	}
+	ca := &LocalCA{Dir: dir, HostPolicy: policy, maxIssued: 2}
+	if err := ca.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	certs := make(chan *tls.Certificate, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			cert, _ := ca.GetCertificate(&tls.ClientHelloInfo{ServerName: "shop.local.example"})
+			certs <- cert
+		}()
+	}
+	waitFor(t, "the policy check", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return checked["shop.local.example"] == 1
+	})
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	first, second := <-certs, <-certs
+	if first == nil || first != second || checked["shop.local.example"] != 1 {
+		t.Errorf("Expected concurrent handshakes to share one certificate, checked the host %d times", checked["shop.local.example"])
+	}
+
+	for _, host := range []string{"a.local.example", "b.local.example", "c.local.example"} {
+		if _, err := ca.GetCertificate(&tls.ClientHelloInfo{ServerName: host}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if statuses := ca.Statuses(time.Now()); len(statuses) != 2 {
+		t.Errorf("Expected the cache to keep 2 certificates, got %+v", statuses)
+	}
+}
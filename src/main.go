@@ -9,13 +9,16 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
+	"time"
 
-	"github.com/davecgh/go-spew/spew"
 	"github.com/namsral/flag"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 
-	"./resolver"
+	"gateway/resolver"
 )
 
 func exitWithError(err error) {
@@ -25,59 +28,225 @@ func exitWithError(err error) {
 
 func main() {
 	var (
+		configPath    string
 		portProxy     int64
+		portHTTPS     int64
 		portInspector int64
+		portAdmin     int64
+		adminToken    string
 		resolverName  string
 		https         bool
+		balancer      = &Balancer{}
+		breakers      = &CircuitBreakers{}
+		retries       = &RetryPolicy{}
+		accessLog     = &AccessLog{}
+		tracing       TracingConfig
+		certStore     = &CertificateStore{}
+		certCacheDir  string
+		certPairs     string
+		tlsMode       string
+		caDir         string
+		localCA       *LocalCA
+		acmeConfig    = &ACMEConfig{}
+		tlsDomains    string
+
+		accessLogOutputName string
+		accessLogMaxSize    int64
+		accessLogMaxBackups int
+
+		inspectorBufferSize int
+		inspectorBodyLimit  int64
+		configWatchInterval time.Duration
 	)
-	HOSTS := make(map[string]string, 0)
-	for _, mapping := range strings.Fields(getEnv("PROXY_MAPPINGS", "")) {
-		hhp := strings.Split(mapping, ":")
-		HOSTS[hhp[0]] = mapping
-	}
-	httpHosts := make(map[string]string, 0)
-	for _, host := range strings.Fields(getEnv("HTTP", "")) {
-		httpHosts[host] = host
-	}
+	// -config points to our own YAML file, not to a flag file for the parser
+	flag.DefaultConfigFlagname = ""
+	flag.StringVar(&configPath, "config", "", "YAML file to read the configuration from")
+	flag.DurationVar(&configWatchInterval, "config-watch-interval", 2*time.Second, "How often to check the config file for changed routes (0 disables)")
 	flag.Int64Var(&portProxy, "port", 80, "Port gateway proxy will be listening on")
+	flag.Int64Var(&portHTTPS, "port-https", 443, "Port gateway proxy will be listening on for https")
 	flag.Int64Var(&portInspector, "port-inspector", 0, "Port gateway inspector will be listening on")
+	flag.Int64Var(&portAdmin, "port-admin", 0, "Port the admin API will be listening on")
+	flag.StringVar(&adminToken, "admin-token", "", "Bearer token required by the admin API")
+	flag.IntVar(&inspectorBufferSize, "inspector-buffer-size", 500, "Number of requests kept by the inspector")
+	flag.Int64Var(&inspectorBodyLimit, "inspector-body-limit", 64*1024, "Number of body bytes kept per request and response by the inspector")
 	flag.StringVar(&resolverName, "destination-resolver", "subnet", "The destination resolver to use (subnet, docker)")
 	flag.BoolVar(&https, "https", false, "Redirect all mapped hosts to https")
+	flag.StringVar(&tlsMode, "tls-mode", acmeMode, "Where certificates come from (acme, local-ca), for the hosts without a static certificate")
+	flag.StringVar(&caDir, "tls-ca-dir", "/app/ca", "Directory the root certificate and key of the local CA are kept in")
+	flag.StringVar(&acmeConfig.Directory, "acme-directory", acme.LetsEncryptURL, "Directory URL of the ACME server certificates are requested from (staging for Let's Encrypt staging)")
+	flag.StringVar(&acmeConfig.Email, "acme-email", "", "Contact email of the ACME account")
+	flag.StringVar(&acmeConfig.EABKeyID, "acme-eab-kid", "", "Key identifier of the external account binding, for ACME servers requiring one")
+	flag.StringVar(&acmeConfig.EABKey, "acme-eab-key", "", "Base64url encoded HMAC key of the external account binding")
+	flag.StringVar(&acmeConfig.Challenges, "acme-challenges", http01+","+tlsALPN01, "Comma separated ACME challenge types answered (http-01, tls-alpn-01)")
+	flag.StringVar(&tlsDomains, "tls-domains", "", "Comma separated domains routed hosts must belong to for a certificate to be requested or issued (empty allows all)")
+	flag.StringVar(&certCacheDir, "tls-cache-dir", "/app/certs", "Directory the certificates issued by Let's Encrypt are cached in")
+	flag.StringVar(&certStore.Dir, "tls-certificates-dir", "", "Directory of certificates (.crt or .pem, with a .key of the same name) served instead of requesting them")
+	flag.StringVar(&certPairs, "tls-certificates", "", "Comma separated cert.pem:key.pem pairs served instead of requesting certificates")
+	flag.StringVar(&balancer.Policy, "load-balancing", roundRobin, "How requests are balanced across the endpoints of a route (round-robin, least-connections, random, hash)")
+	flag.StringVar(&balancer.HashHeader, "load-balancing-hash-header", "", "Request header hashed by the hash load balancing policy")
+	flag.StringVar(&balancer.HashCookie, "load-balancing-hash-cookie", "", "Cookie hashed by the hash load balancing policy")
+	flag.IntVar(&breakers.Failures, "circuit-breaker-failures", 5, "Failed requests in a row that open the circuit breaker of an endpoint (0 disables)")
+	flag.Float64Var(&breakers.ErrorRate, "circuit-breaker-error-rate", 0.5, "Share of failed requests in the window that opens the circuit breaker of an endpoint (0 disables)")
+	flag.IntVar(&breakers.Window, "circuit-breaker-window", 20, "Number of recent requests the error rate is computed over")
+	flag.IntVar(&retries.Attempts, "retries", 2, "How many times a request that failed to reach the backend is retried (0 disables)")
+	flag.DurationVar(&retries.Backoff, "retry-backoff", 100*time.Millisecond, "Wait before the first retry, doubled before each next one")
+	flag.DurationVar(&breakers.OpenDuration, "circuit-breaker-open-duration", 30*time.Second, "How long an open circuit breaker turns requests away before probing the endpoint")
+	flag.StringVar(&accessLogOutputName, "access-log", "stdout", "Where the access log is written: stdout, stderr, a file path, or off")
+	flag.StringVar(&accessLog.Format, "access-log-format", combinedFormat, "Access log format (combined, json, logfmt)")
+	flag.Int64Var(&accessLogMaxSize, "access-log-max-size", 100, "Size in megabytes an access log file is rotated at (0 disables)")
+	flag.IntVar(&accessLogMaxBackups, "access-log-max-backups", 5, "Number of rotated access log files kept")
+	flag.StringVar(&tracing.Exporter, "tracing", "", "Where request traces are exported to (otlp, file), empty disables tracing")
+	flag.StringVar(&tracing.Endpoint, "tracing-otlp-endpoint", "http://localhost:4318", "OTLP/HTTP collector the otlp exporter sends traces to")
+	flag.StringVar(&tracing.File, "tracing-file", "traces.json", "File the file exporter writes traces to")
+	flag.StringVar(&tracing.ServiceName, "tracing-service-name", "gateway", "Service name of the gateway spans")
+	flag.Float64Var(&tracing.SampleRatio, "tracing-sample-ratio", 1, "Share of the traces started by the gateway that are sampled")
+
+	flag.Parse()
+	config := &Config{}
+	if configPath != "" {
+		var err error
+		if config, err = loadConfig(configPath); err != nil {
+			exitWithError(err)
+		}
+		if err = config.exportEnv(); err != nil {
+			exitWithError(err)
+		}
+		flag.Parse()
+	}
+	if err := validPolicy(balancer.Policy); err != nil {
+		exitWithError(err)
+	}
+	if err := validLogFormat(accessLog.Format); err != nil {
+		exitWithError(err)
+	}
+	if err := validTLSMode(tlsMode); err != nil {
+		exitWithError(err)
+	}
+	if err := acmeConfig.validate(); err != nil {
+		exitWithError(err)
+	}
+	if portAdmin != 0 && adminToken == "" {
+		exitWithError(errors.New("The admin API needs an admin-token"))
+	}
 
-	ps := &ProxyServer{}
+	httpHosts := make(map[string]string, 0)
+	for _, host := range strings.Fields(getEnv("HTTP", "")) {
+		httpHosts[host] = host
+	}
+	health := &HealthChecker{}
+	ps := &ProxyServer{balancer: balancer, health: health, breakers: breakers, retries: retries, routes: config.Routes}
 	ps.AddDestinationResolvers(
-		&resolver.Subnet{},
-		&resolver.Docker{},
+		&resolver.Subnet{Routes: config.Routes},
+		&resolver.Docker{Routes: config.Routes, Weights: config.Resolver.Docker.Weights},
 	)
-
-	flag.Parse()
 	ps.SetActiveDestinationResolver(resolverName)
+	go watchReloads(configPath, configWatchInterval, func() {
+		routes := config.Routes
+		if configPath != "" {
+			reloaded, err := loadConfig(configPath)
+			if err != nil {
+				log.Printf("Keeping current routes: %v", err)
+				return
+			}
+			routes = reloaded.Routes
+		}
+		ps.SetRoutes(routes)
+	})
+
+	go health.Watch(ps.Destinations, time.Second)
+	hostPolicy := &HostPolicy{Proxy: ps, Hosts: config.TLS.Hosts, Domains: strings.FieldsFunc(tlsDomains, func(c rune) bool { return c == ',' || c == ' ' })}
+
+	certCache := autocert.DirCache(certCacheDir)
+	var certificates func() []CertificateStatus
+	if https {
+		certStore.Pairs = parseCertificatePairs(certPairs)
+		if err := certStore.Load(); err != nil {
+			exitWithError(err)
+		}
+		go certStore.Watch(configWatchInterval)
+		if tlsMode == localCAMode {
+			localCA = &LocalCA{Dir: caDir, HostPolicy: hostPolicy.Allow}
+			if len(hostPolicy.Domains) > 0 {
+				// the listed hosts are allowed whatever their domain
+				localCA.Domains = append(append([]string{}, hostPolicy.Domains...), hostPolicy.Hosts...)
+			}
+			if err := localCA.Load(); err != nil {
+				exitWithError(err)
+			}
+		}
+		certificates = func() []CertificateStatus {
+			if localCA != nil {
+				return append(certStore.Statuses(time.Now()), localCA.Statuses(time.Now())...)
+			}
+			hosts := []string{}
+			for _, host := range hostPolicy.Candidates() {
+				if !certStore.Covers(host) {
+					hosts = append(hosts, host)
+				}
+			}
+			sort.Strings(hosts)
+			return append(certStore.Statuses(time.Now()), certificateStatuses(context.Background(), certCache, hosts, time.Now())...)
+		}
+		prometheus.MustRegister(&certificateCollector{statuses: certificates})
+	}
 
-	handler := ps.Handler
+	if _, err := setupTracing(tracing); err != nil {
+		exitWithError(err)
+	}
+	logRequests := func(h http.HandlerFunc) http.HandlerFunc {
+		return withRequestID(traceRequests(h))
+	}
+	if accessLogOutputName != "off" && accessLogOutputName != "" {
+		output, err := accessLogOutput(accessLogOutputName, accessLogMaxSize<<20, accessLogMaxBackups)
+		if err != nil {
+			exitWithError(err)
+		}
+		accessLog.Output = output
+		logRequests = func(h http.HandlerFunc) http.HandlerFunc {
+			return withRequestID(traceRequests(accessLog.Wrap(h)))
+		}
+	}
+
+	handler := instrument(ps.Handler)
 	if portInspector != 0 {
-		handler = wrapHandler(handler, portInspector)
+		inspector := &Inspector{Capacity: inspectorBufferSize, BodyLimit: inspectorBodyLimit, Health: health, Breakers: breakers, Deployments: ps.DeploymentManager(), CA: localCA}
+		handler = inspector.Wrap(handler)
+		go (func() {
+			log.Fatal(inspector.ListenAndServe(portInspector))
+		})()
+	}
+	if portAdmin != 0 {
+		admin := &Admin{Token: adminToken, Proxy: ps, Health: health, Certificates: certificates}
+		go (func() {
+			log.Fatal(admin.ListenAndServe(portAdmin))
+		})()
 	}
 	defaultHandler := handler
 	if https {
-		m := autocert.Manager{
-			Cache:  autocert.DirCache("/app/certs"),
-			Prompt: autocert.AcceptTOS,
-			HostPolicy: func(ctx context.Context, host string) error {
-				if _, ok := HOSTS[host]; ok {
-					return nil
-				}
-				return errors.New("Unkown host(" + host + ")")
-			},
+		var tlsConfig *tls.Config
+		redirect := wrapRedirect(httpHosts, ps, defaultHandler)
+		if localCA != nil {
+			tlsConfig = &tls.Config{GetCertificate: certStore.GetCertificate(localCA.GetCertificate)}
+		} else {
+			m, err := acmeConfig.manager(certCache, func(ctx context.Context, host string) error {
+				return hostPolicy.Allow(host)
+			})
+			if err != nil {
+				exitWithError(err)
+			}
+			tlsConfig = acmeConfig.tlsConfig(certStore.GetCertificate(m.GetCertificate))
+			redirect = acmeConfig.httpHandler(m, redirect)
 		}
+		tlsConfig.GetConfigForClient = ps.clientAuthConfig(tlsConfig)
 		s := &http.Server{
-			Addr:      ":https",
-			TLSConfig: &tls.Config{GetCertificate: m.GetCertificate},
-			Handler:   http.HandlerFunc(handler),
+			Addr:      fmt.Sprintf(":%d", portHTTPS),
+			TLSConfig: tlsConfig,
+			Handler:   logRequests(handler),
 		}
 		go (func() {
 			log.Fatal(s.ListenAndServeTLS("", ""))
 		})()
-		handler = m.HTTPHandler(wrapRedirect(httpHosts, defaultHandler)).ServeHTTP
+		handler = redirect.ServeHTTP
 	}
 	// http.HandleFunc (path, func redirect(w http.ResponseWriter, r *http.Request))
 	// func (f HandlerFunc) ServeHTTP(w ResponseWriter, r *Request)
@@ -88,7 +257,7 @@ func main() {
 
 	// func ListenAndServe(addr string, handler Handler) error
 
-	http.HandleFunc("/", handler)
+	http.HandleFunc("/", logRequests(handler))
 
 	fmt.Println("gatway proxy listening on port", portProxy)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", portProxy), nil))
@@ -101,11 +270,9 @@ func stripPort(hostport string) string {
 	return host
 }
 
-func wrapRedirect(hosts map[string]string, h http.HandlerFunc) http.Handler {
-	fmt.Println("wrapping")
+func wrapRedirect(hosts map[string]string, ps *ProxyServer, h http.HandlerFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%#v [%#v]", hosts, r.URL)
-		if _, ok := hosts[stripPort(r.Host)]; ok {
+		if _, ok := hosts[stripPort(r.Host)]; ok || ps.ServesHTTP(r) {
 			h(w, r)
 			return
 		}
@@ -114,7 +281,6 @@ func wrapRedirect(hosts map[string]string, h http.HandlerFunc) http.Handler {
 			//http.Redirect(w, r, "https://"+stripPort(r.Host)+r.URL.RequestURI(), http.StatusTemporaryRedirect) //http.StatusFound)
 			http.Error(w, "Use HTTPS ("+r.Method+") '"+"https://"+stripPort(r.Host)+r.URL.RequestURI()+"'", http.StatusBadRequest)
 			return
-			spew.Dump(r)
 		}
 		http.Redirect(w, r, "https://"+stripPort(r.Host)+r.URL.RequestURI(), http.StatusFound)
 	})
@@ -127,16 +293,6 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
-func wrapHandler(h http.HandlerFunc, port int64) http.HandlerFunc {
-	fmt.Println("gatway inspector listening on port", port)
-	return func(w http.ResponseWriter, r *http.Request) {
-		//if !currentUser(r).IsAdmin {
-		//    http.NotFound(w, r)
-		//    return
-		//}
-		h(w, r)
-	}
-}
 func hello(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Hello astaxie!") // send data to client side
 }
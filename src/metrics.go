@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_requests_total",
+		Help: "Requests proxied, by route and status class.",
+	}, []string{"route", "status"})
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gateway_request_duration_seconds",
+		Help:    "Time to serve proxied requests, by route and status class.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "status"})
+	requestsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gateway_requests_in_flight",
+		Help: "Requests being proxied, by route.",
+	}, []string{"route"})
+	websocketsOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gateway_websocket_connections",
+		Help: "Websocket connections open, by route.",
+	}, []string{"route"})
+	websocketsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_websocket_connections_total",
+		Help: "Websocket connections proxied, by route.",
+	}, []string{"route"})
+	websocketBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_websocket_bytes_total",
+		Help: "Bytes proxied over websocket connections, by route and direction (in from the client, out to it).",
+	}, []string{"route", "direction"})
+	breakerStates = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gateway_circuit_breaker_state",
+		Help: "State of the circuit breaker of each destination endpoint: 0 closed, 1 open, 2 half-open.",
+	}, []string{"destination"})
+	breakerTripsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_circuit_breaker_trips_total",
+		Help: "Times the circuit breaker of each destination endpoint opened.",
+	}, []string{"destination"})
+	resolverFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_resolver_failures_total",
+		Help: "Requests no destination was found for, by resolver.",
+	}, []string{"resolver"})
+)
+
+// fallbackRoute labels the requests that matched no route. Their host comes
+// from the client, so it is never used as a label.
+const fallbackRoute = "fallback"
+
+// routeLabel returns the route label of requests to the named route
+func routeLabel(name string) string {
+	if name == "" {
+		return fallbackRoute
+	}
+	return name
+}
+
+// statusClass returns the class of an http status, as in 2xx
+func statusClass(status int) string {
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+// instrument counts and times the requests served by h. Websocket sessions
+// are counted when they end, but not timed.
+func instrument(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r, info := withRequestInfo(r)
+		started := time.Now()
+		rw := &recordingResponseWriter{ResponseWriter: w, body: &captureBuffer{}}
+
+		h(rw, r)
+
+		labels := prometheus.Labels{"route": routeLabel(info.RouteName), "status": statusClass(rw.statusCode())}
+		requestsTotal.With(labels).Inc()
+		if !rw.hijacked {
+			requestDuration.With(labels).Observe(time.Since(started).Seconds())
+		}
+	}
+}
+
+// inFlight counts a request of the route as being proxied until the returned
+// function is called.
+func inFlight(route string) func() {
+	gauge := requestsInFlight.WithLabelValues(routeLabel(route))
+	gauge.Inc()
+	return gauge.Dec
+}
+
+// certificateCollector exports the expiry of the certificates of the served
+// hosts, read at every scrape.
+type certificateCollector struct {
+	statuses func() []CertificateStatus
+}
+
+var certificateExpiry = prometheus.NewDesc(
+	"gateway_certificate_expiry_timestamp_seconds",
+	"When the cached certificate of a host expires, in seconds since the epoch.",
+	[]string{"host", "issuer"}, nil,
+)
+
+func (c *certificateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- certificateExpiry
+}
+
+func (c *certificateCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, status := range c.statuses() {
+		if status.NotAfter.IsZero() {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(certificateExpiry, prometheus.GaugeValue, float64(status.NotAfter.Unix()), status.Host, status.Issuer)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrumentCountsRequests(t *testing.T) {
+	handler := instrument(func(w http.ResponseWriter, r *http.Request) {
+		info := requestInfo(r)
+		info.RouteName, info.Destination = "metrics-test", "shop:80"
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+		}
+	})
+	for _, path := range []string{"/", "/", "/missing"} {
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "http://shop"+path, nil))
+	}
+
+	if ok := testutil.ToFloat64(requestsTotal.WithLabelValues("metrics-test", "2xx")); ok != 2 {
+		t.Errorf("Expected 2 successful requests, got %v", ok)
+	}
+	if missing := testutil.ToFloat64(requestsTotal.WithLabelValues("metrics-test", "4xx")); missing != 1 {
+		t.Errorf("Expected 1 client error, got %v", missing)
+	}
+	if observed := testutil.CollectAndCount(requestDuration, "gateway_request_duration_seconds"); observed == 0 {
+		t.Errorf("Expected request durations to be observed")
+	}
+}
+
+func TestInstrumentLabelsUnroutedRequests(t *testing.T) {
+	handler := instrument(func(w http.ResponseWriter, r *http.Request) {
+		requestInfo(r).Destination = r.Host
+		w.WriteHeader(http.StatusTeapot)
+	})
+	for _, host := range []string{"a.example.test:1", "b.example.test:2"} {
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "http://"+host+"/", nil))
+	}
+
+	if unrouted := testutil.ToFloat64(requestsTotal.WithLabelValues(fallbackRoute, "4xx")); unrouted != 2 {
+		t.Errorf("Expected both unrouted requests to share the fallback route, got %v", unrouted)
+	}
+}
+
+func TestCertificateCollector(t *testing.T) {
+	notAfter := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	collector := &certificateCollector{statuses: func() []CertificateStatus {
+		return []CertificateStatus{
+			{Host: "shop.example.test", Status: "valid", Issuer: "Test CA", NotAfter: notAfter},
+			{Host: "new.example.test", Status: "missing"},
+		}
+	}}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	expected := `
+# HELP gateway_certificate_expiry_timestamp_seconds When the cached certificate of a host expires, in seconds since the epoch.
+# TYPE gateway_certificate_expiry_timestamp_seconds gauge
+gateway_certificate_expiry_timestamp_seconds{host="shop.example.test",issuer="Test CA"} 1.893456e+09
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
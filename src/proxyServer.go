@@ -1,7 +1,7 @@
 package main
 
 import (
-	"./resolver"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
@@ -10,11 +10,31 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"gateway/resolver"
 )
 
 type ProxyServer struct {
 	destinationResolver  resolver.DestinationResolver
 	destinationResolvers map[string]resolver.DestinationResolver
+	balancer             *Balancer
+	health               *HealthChecker
+	breakers             *CircuitBreakers
+	retries              *RetryPolicy
+
+	// routes are the configured routes, which overrides are applied on top of
+	routesMu     sync.Mutex
+	routes       []resolver.Route
+	overrides    []RouteOverride
+	lastOverride int
+
+	clientCAs clientCAPools
 }
 
 func (s *ProxyServer) AddDestinationResolvers(dstRes ...resolver.DestinationResolver) {
@@ -35,9 +55,46 @@ func (s *ProxyServer) SetActiveDestinationResolver(name string) {
 	exitWithError(errors.New(fmt.Sprintf("Unknown destination resolver '%s'", name)))
 }
 
+// Destinations returns the destination of every route of the active resolver.
+func (s *ProxyServer) Destinations() []resolver.Destination {
+	return s.destinationResolver.Destinations()
+}
+
+// Resolver returns the active destination resolver.
+func (s *ProxyServer) Resolver() resolver.DestinationResolver {
+	return s.destinationResolver
+}
+
+// DeploymentManager returns the active resolver when it splits deployments
+// between stacks, nil otherwise.
+func (s *ProxyServer) DeploymentManager() resolver.DeploymentManager {
+	manager, _ := s.destinationResolver.(resolver.DeploymentManager)
+	return manager
+}
+
+// ServesHTTP tells whether the request matches a route that is served over
+// plain http, even when https is enabled.
+func (s *ProxyServer) ServesHTTP(r *http.Request) bool {
+	destination, err := s.destinationResolver.Resolve(r)
+	return err == nil && destination.Route != nil && destination.Route.HTTP
+}
+
+// Routable tells whether the active resolver routes the host. Resolvers that
+// cannot tell are asked for the destination of a request to the host.
+func (s *ProxyServer) Routable(host string) bool {
+	if router, ok := s.destinationResolver.(resolver.HostRouter); ok {
+		return router.Routable(host)
+	}
+	_, err := s.destinationResolver.Resolve(resolver.HostRequest(host, "/"))
+	return err == nil
+}
+
 func (s *ProxyServer) Websocket(target string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := requestInfo(r)
+		dialed := time.Now()
 		d, err := net.Dial("tcp", target)
+		info.UpstreamLatency = time.Since(dialed)
 		if err != nil {
 			http.Error(w, "Error contacting backend server.", 500)
 			log.Printf("Error dialing websocket backend %s: %v", target, err)
@@ -56,19 +113,32 @@ func (s *ProxyServer) Websocket(target string) http.Handler {
 		defer nc.Close()
 		defer d.Close()
 
+		injectTrace(r.Context(), r.Header)
 		err = r.Write(d)
 		if err != nil {
 			log.Printf("Error copying request to target: %v", err)
 			return
 		}
 
+		route := routeLabel(info.RouteName)
+		websocketsTotal.WithLabelValues(route).Inc()
+		websocketsOpen.WithLabelValues(route).Inc()
+		defer websocketsOpen.WithLabelValues(route).Dec()
+
 		errc := make(chan error, 2)
-		cp := func(dst io.Writer, src io.Reader) {
-			_, err := io.Copy(dst, src)
+		cp := func(dst io.Writer, src io.Reader, direction string, count *int64) {
+			n, err := io.Copy(dst, src)
+			websocketBytes.WithLabelValues(route, direction).Add(float64(n))
+			*count = n
 			errc <- err
 		}
-		go cp(d, nc)
-		go cp(nc, d)
+		go cp(d, nc, "in", &info.WebsocketBytesIn)
+		go cp(nc, d, "out", &info.WebsocketBytesOut)
+		<-errc
+		// closing both ends stops the other copy, so the session is over
+		// when the handler returns
+		nc.Close()
+		d.Close()
 		<-errc
 	})
 }
@@ -85,15 +155,101 @@ func (s *ProxyServer) IsWebsocket(req *http.Request) bool {
 	return (strings.ToLower(req.Header["Upgrade"][0]) == "websocket")
 }
 
-func (s *ProxyServer) Handler(w http.ResponseWriter, r *http.Request) {
-	dstHostPort, err := s.destinationResolver.GetDestinationHostPort(r.Host)
+// rewritePath returns the request to forward, with its path stripped or
+// rewritten as the route asks.
+func rewritePath(r *http.Request, route *resolver.Route) *http.Request {
+	path := route.RewritePath(r.URL.Path)
+	if path == r.URL.Path {
+		return r
+	}
+	rewritten := r.WithContext(r.Context())
+	u := *r.URL
+	u.Path, u.RawPath = path, ""
+	rewritten.URL = &u
+	rewritten.RequestURI = u.RequestURI()
+	return rewritten
+}
+
+// resolve looks the destination of the request up, in a span of its own
+func (s *ProxyServer) resolve(r *http.Request) (resolver.Destination, error) {
+	_, span := tracer().Start(r.Context(), "resolve destination", trace.WithAttributes(
+		attribute.String("gateway.resolver", s.destinationResolver.GetName()),
+	))
+	defer span.End()
+	destination, err := s.destinationResolver.Resolve(r)
 	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return destination, err
+	}
+	span.SetAttributes(attribute.StringSlice("gateway.endpoints", destination.Endpoints))
+	if destination.Route != nil {
+		span.SetAttributes(attribute.String("gateway.route", destination.Route.Name))
+	}
+	return destination, nil
+}
 
-		http.Error(w, err.Error(), 502)
-		return
-		//fmt.Println(err)
+func (s *ProxyServer) Handler(w http.ResponseWriter, r *http.Request) {
+	r, info := withRequestInfo(r)
+	assignRequestID(w, r, info)
+	// the route is looked up for replays as well, so they are rewritten the same way
+	destination, err := s.resolve(r)
+	if err == nil && destination.Route != nil {
+		info.Route = destination.Route.String()
+		info.RouteName = destination.Route.Name
+	}
+	defer inFlight(info.RouteName)()
+	var clientCert *x509.Certificate
+	if err == nil && destination.Route != nil && destination.Route.ClientCA != "" {
+		if clientCert, err = s.clientCAs.verifyClient(r, destination.Route); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	r = withClientCert(r, clientCert)
+	// only the endpoints of routes get a breaker, the fallback proxies to
+	// whatever host the client asks for
+	breakers := s.breakers
+	if destination.Route == nil {
+		breakers = nil
+	}
+	dstHostPort := info.PinnedDestination
+	if dstHostPort == "" {
+		if err != nil {
+			resolverFailures.WithLabelValues(s.destinationResolver.GetName()).Inc()
+			http.Error(w, err.Error(), 502)
+			return
+			//fmt.Println(err)
+		}
+		destination = s.health.Healthy(destination)
+		if len(destination.Endpoints) == 0 {
+			http.Error(w, fmt.Sprintf("No healthy endpoint for %s", destination.Route), http.StatusServiceUnavailable)
+			return
+		}
+		destination = breakers.Available(destination)
+		if len(destination.Endpoints) == 0 {
+			http.Error(w, fmt.Sprintf("Circuit breaker open for every endpoint of %s", r.Host), http.StatusServiceUnavailable)
+			return
+		}
+		var done func()
+		dstHostPort, done = s.balancer.Pick(r, destination)
+		defer done()
+		info.Endpoints = destination.Endpoints
+		info.Stack = destination.Stack
+	}
+	info.Destination = dstHostPort
+	if destination.Route != nil {
+		r = rewritePath(r, destination.Route)
 	}
 
+	ctx, span := tracer().Start(r.Context(), "upstream "+dstHostPort, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("server.address", dstHostPort),
+	))
+	defer func() {
+		span.SetAttributes(attribute.Int("gateway.retries", info.Retries))
+		span.End()
+	}()
+	r = r.WithContext(ctx)
+
 	if s.IsWebsocket(r) {
 		handler := s.Websocket(dstHostPort)
 		handler.ServeHTTP(w, r)
@@ -101,27 +257,22 @@ func (s *ProxyServer) Handler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	handler := &httputil.ReverseProxy{
-		Transport: errorHandlingTransport{http.DefaultTransport},
+		Transport: errorHandlingTransport{RoundTripper: http.DefaultTransport, breakers: breakers, retries: s.retries},
 		Director: func(req *http.Request) {
 			req.URL.Host = dstHostPort
 			req.URL.Scheme = "http"
+			req.Header.Set(requestIDHeader, info.RequestID)
+			injectTrace(req.Context(), req.Header)
+		},
+		// the backend may answer with an id of its own
+		ModifyResponse: func(resp *http.Response) error {
+			resp.Header.Set(requestIDHeader, info.RequestID)
+			span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+			if resp.StatusCode >= 500 {
+				span.SetStatus(codes.Error, resp.Status)
+			}
+			return nil
 		},
 	}
 	handler.ServeHTTP(w, r)
-	//loggingRW := &loggingResponseWriter{
-	//	ResponseWriter: w,
-	//}
-	//h.ServeHTTP(loggingRW, r)
-	//requestDump, err := httputil.DumpRequest(r, true)
-	//handler.ServeHTTP(loggingRW, r)
-	//
-	//	if err != nil {
-	//		fmt.Println(err)
-	//	}
-	/*if os.Getenv("INSPECT_TRAFFIC") != "" {
-		log.Println("#######################################################################")
-		log.Println(r.Method, r.URL.Path)
-		log.Println(string(requestDump))
-		log.Println("Status : ", loggingRW.status, "Header : ", loggingRW.Header(), "Response : ", string(loggingRW.body))
-	}*/
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"gateway/resolver"
+)
+
+// RouteOverride is a route added at runtime through the admin API. It wins
+// over the configured route with the same host and conditions, and is gone
+// once it expires or the gateway restarts.
+type RouteOverride struct {
+	ID    int            `json:"id"`
+	Route resolver.Route `json:"route"`
+	// Expires is zero for overrides kept until removed
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+func (o *RouteOverride) expired(now time.Time) bool {
+	return !o.Expires.IsZero() && !now.Before(o.Expires)
+}
+
+// SetRoutes hands a new set of configured routes to the active resolver.
+func (s *ProxyServer) SetRoutes(routes []resolver.Route) {
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+	s.routes = routes
+	s.applyRoutes()
+}
+
+// applyRoutes hands the configured routes and the overrides that did not
+// expire to the active resolver. Overrides come last, so they replace the
+// configured route they share a host and conditions with.
+func (s *ProxyServer) applyRoutes() {
+	now := time.Now()
+	routes := append([]resolver.Route{}, s.routes...)
+	overrides := s.overrides[:0]
+	for _, override := range s.overrides {
+		if override.expired(now) {
+			log.Printf("Route override %d expired: %s", override.ID, override.Route.String())
+			continue
+		}
+		overrides = append(overrides, override)
+		routes = append(routes, override.Route)
+	}
+	s.overrides = overrides
+	s.destinationResolver.SetRoutes(routes)
+}
+
+// Override adds a route on top of the configured ones for ttl, or until
+// removed when ttl is 0.
+func (s *ProxyServer) Override(route resolver.Route, ttl time.Duration) RouteOverride {
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+	s.lastOverride++
+	override := RouteOverride{ID: s.lastOverride, Route: route}
+	if ttl > 0 {
+		override.Expires = time.Now().Add(ttl)
+		time.AfterFunc(ttl, func() {
+			s.routesMu.Lock()
+			defer s.routesMu.Unlock()
+			s.applyRoutes()
+		})
+	}
+	s.overrides = append(s.overrides, override)
+	s.applyRoutes()
+	return override
+}
+
+// RemoveOverride removes the override with the given id, and tells whether
+// there was one.
+func (s *ProxyServer) RemoveOverride(id int) bool {
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+	for n, override := range s.overrides {
+		if override.ID == id {
+			s.overrides = append(s.overrides[:n], s.overrides[n+1:]...)
+			s.applyRoutes()
+			return true
+		}
+	}
+	return false
+}
+
+// Overrides returns the route overrides in the order they were added.
+func (s *ProxyServer) Overrides() []RouteOverride {
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+	now := time.Now()
+	overrides := []RouteOverride{}
+	for _, override := range s.overrides {
+		if !override.expired(now) {
+			overrides = append(overrides, override)
+		}
+	}
+	return overrides
+}
+
+// watchReloads calls reload on SIGHUP, and when the config file changes. The
+// file is polled rather than watched through inotify, as events are not
+// delivered reliably for files bind mounted into a container.
+func watchReloads(configPath string, interval time.Duration, reload func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	modified := configModTime(configPath)
+	if configPath != "" && interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+
+	for {
+		select {
+		case <-hup:
+			log.Println("Reloading routes (SIGHUP)")
+		case <-tick:
+			current := configModTime(configPath)
+			if current.Equal(modified) {
+				continue
+			}
+			modified = current
+			log.Printf("Reloading routes (%s changed)", configPath)
+		}
+		reload()
+	}
+}
+
+func configModTime(path string) time.Time {
+	if path == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"gateway/resolver"
+)
+
+func TestReloadKeepsResolvedRequests(t *testing.T) {
+	arrived, release := make(chan bool), make(chan bool)
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				arrived <- true
+				<-release
+			}
+			w.Write([]byte(name))
+		}))
+	}
+	v1, v2 := backend("v1"), backend("v2")
+	defer v1.Close()
+	defer v2.Close()
+	routes := func(backend *httptest.Server) []resolver.Route {
+		return resolver.ParseProxyMappings("shop:" + strings.TrimPrefix(backend.URL, "http://"))
+	}
+	subnet := &resolver.Subnet{}
+	ps := &ProxyServer{destinationResolver: subnet}
+	ps.SetRoutes(routes(v1))
+	get := func(path string) string {
+		w := httptest.NewRecorder()
+		ps.Handler(w, httptest.NewRequest("GET", "http://shop"+path, nil))
+		return w.Body.String()
+	}
+
+	inFlight := make(chan string)
+	go func() { inFlight <- get("/slow") }()
+	<-arrived
+
+	ps.SetRoutes(routes(v2))
+	if got := get("/"); got != "v2" {
+		t.Errorf("Expected new requests to use the reloaded routes, got %q", got)
+	}
+	close(release)
+	if got := <-inFlight; got != "v1" {
+		t.Errorf("Expected the request resolved before the reload to finish on v1, got %q", got)
+	}
+}
+
+func TestWatchReloads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "gateway.yaml")
+	ioutil.WriteFile(config, []byte("routes: []"), 0644)
+	var reloads int32
+	go watchReloads(config, 10*time.Millisecond, func() { atomic.AddInt32(&reloads, 1) })
+
+	time.Sleep(30 * time.Millisecond)
+	if atomic.LoadInt32(&reloads) != 0 {
+		t.Fatal("Expected no reload while the config file is unchanged")
+	}
+	later := time.Now().Add(time.Second)
+	os.Chtimes(config, later, later)
+	waitFor(t, "the changed config file to be reloaded", func() bool { return atomic.LoadInt32(&reloads) == 1 })
+
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	waitFor(t, "SIGHUP to reload", func() bool { return atomic.LoadInt32(&reloads) == 2 })
+}
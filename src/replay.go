@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+// replayEdits are the optional changes applied to a captured request before
+// it is sent again. Fields left out keep their captured value; a header set
+// to an empty list is removed.
+type replayEdits struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   *string     `json:"body"`
+}
+
+// handleReplay sends a captured request, with the edits posted in the body,
+// through the proxy handler again. The replay goes to the destination the
+// original request was resolved to and is recorded like any other exchange.
+func (i *Inspector) handleReplay(w http.ResponseWriter, r *http.Request, e *Exchange) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if i.handler == nil {
+		http.Error(w, "Inspector is not recording any handler", http.StatusServiceUnavailable)
+		return
+	}
+	if e.Websocket {
+		http.Error(w, "Websocket sessions can not be replayed", http.StatusBadRequest)
+		return
+	}
+	if e.Destination == "" {
+		http.Error(w, "Request was never resolved to a destination", http.StatusBadRequest)
+		return
+	}
+
+	edits := replayEdits{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&edits); err != nil && err != io.EOF {
+			http.Error(w, "Invalid replay edits: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if edits.Body == nil && e.RequestBodyTruncated {
+		http.Error(w, "Captured request body was truncated, supply the body to replay it", http.StatusBadRequest)
+		return
+	}
+
+	req, err := e.replayRequest(edits)
+	if err != nil {
+		http.Error(w, "Invalid replay request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.RemoteAddr = r.RemoteAddr
+	req, info := withRequestInfo(req)
+	info.PinnedDestination = e.Destination
+
+	replayed := i.record(i.handler, httptest.NewRecorder(), req)
+	writeJSON(w, http.StatusOK, replayed)
+}
+
+func (e *Exchange) replayRequest(edits replayEdits) (*http.Request, error) {
+	method, uri, body := e.Method, e.URL, e.RequestBody
+	if edits.Method != "" {
+		method = edits.Method
+	}
+	if edits.URL != "" {
+		uri = edits.URL
+	}
+	if edits.Body != nil {
+		body = *edits.Body
+	}
+
+	req, err := http.NewRequest(method, e.Scheme+"://"+e.Host+uri, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Host = e.Host
+	req.Header = e.RequestHeader.Clone()
+	// a replay is a request of its own, unless the edits set an id
+	req.Header.Del(requestIDHeader)
+	for name, values := range edits.Header {
+		if len(values) == 0 {
+			req.Header.Del(name)
+			continue
+		}
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	// The body may have been edited, let the transport work out the length
+	req.Header.Del("Content-Length")
+	if body == "" {
+		req.Body = http.NoBody
+	}
+	return req, nil
+}
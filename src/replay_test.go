@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gateway/resolver"
+)
+
+func TestReplay(t *testing.T) {
+	received := make(chan string, 10)
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			received <- name + " " + r.Method + " " + r.URL.RequestURI() + " " + r.Header.Get("X-Debug") + " " + string(body)
+		}))
+	}
+	original, updated := backend("original"), backend("updated")
+	defer original.Close()
+	defer updated.Close()
+	subnet := &resolver.Subnet{}
+	subnet.SetRoutes(resolver.ParseProxyMappings("shop:" + strings.TrimPrefix(original.URL, "http://")))
+	inspector := &Inspector{Capacity: 10, BodyLimit: 1024}
+	handler := inspector.Wrap((&ProxyServer{destinationResolver: subnet}).Handler)
+
+	r := httptest.NewRequest("POST", "http://shop/orders", strings.NewReader("first"))
+	r.Header.Set("X-Debug", "0")
+	handler(httptest.NewRecorder(), r)
+	if got := <-received; got != "original POST /orders 0 first" {
+		t.Fatalf("Unexpected request %q", got)
+	}
+
+	// the route moved on since, the replay still goes where the capture went
+	subnet.SetRoutes(resolver.ParseProxyMappings("shop:" + strings.TrimPrefix(updated.URL, "http://")))
+	replay := func(edits string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		inspector.ServeMux().ServeHTTP(w, httptest.NewRequest("POST", "/api/exchanges/1/replay", strings.NewReader(edits)))
+		return w
+	}
+	w := replay(`{"url": "/orders?debug=1", "header": {"X-Debug": ["1"]}, "body": "edited"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the replay to be sent, got %d %s", w.Code, w.Body)
+	}
+	if got := <-received; got != "original POST /orders?debug=1 1 edited" {
+		t.Errorf("Expected the edited request on the original destination, got %q", got)
+	}
+	replayed := Exchange{}
+	json.Unmarshal(w.Body.Bytes(), &replayed)
+	if replayed.ID != 2 || replayed.Destination != strings.TrimPrefix(original.URL, "http://") || replayed.RequestBody != "edited" {
+		t.Errorf("Expected the replay to be recorded, got %+v", replayed)
+	}
+
+	if w := replay(""); w.Code != http.StatusOK || <-received != "original POST /orders 0 first" {
+		t.Errorf("Expected the captured request to be sent again as it was, got %d", w.Code)
+	}
+	if w := replay(`{"header": {"X-Debug": []}}`); w.Code != http.StatusOK || <-received != "original POST /orders  first" {
+		t.Errorf("Expected the header to be removed, got %d", w.Code)
+	}
+}
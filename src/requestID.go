@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// requestIDHeader carries the id correlating a request across the client,
+// the gateway logs and the backend.
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID tells whether an id sent by the client can be kept: short
+// and made of printable characters without spaces, so it is safe to log.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 200 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// assignRequestID keeps the id the request came with, or generates one, and
+// echoes it in the response. Requests that already have one are left alone.
+func assignRequestID(w http.ResponseWriter, r *http.Request, info *RequestInfo) {
+	if info.RequestID != "" {
+		return
+	}
+	info.RequestID = r.Header.Get(requestIDHeader)
+	if !validRequestID(info.RequestID) {
+		info.RequestID = newRequestID()
+	}
+	r.Header.Set(requestIDHeader, info.RequestID)
+	w.Header().Set(requestIDHeader, info.RequestID)
+}
+
+// withRequestID assigns an id to every request before handing it to h.
+func withRequestID(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r, info := withRequestInfo(r)
+		assignRequestID(w, r, info)
+		h(w, r)
+	}
+}
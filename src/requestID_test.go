@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gateway/resolver"
+)
+
+func TestRequestIDPropagation(t *testing.T) {
+	received := ""
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("X-Request-ID")
+		w.Header().Set("X-Request-ID", "backend-id")
+	}))
+	defer backend.Close()
+
+	subnet := &resolver.Subnet{}
+	subnet.SetRoutes(resolver.ParseProxyMappings("shop:" + strings.TrimPrefix(backend.URL, "http://")))
+	ps := &ProxyServer{destinationResolver: subnet}
+
+	w := httptest.NewRecorder()
+	ps.Handler(w, httptest.NewRequest("GET", "http://shop/", nil))
+	id := w.Header().Get("X-Request-ID")
+	if len(id) != 32 || received != id {
+		t.Errorf("Expected a generated id sent to the backend and echoed, got %q sent and %q echoed", received, id)
+	}
+
+	r := httptest.NewRequest("GET", "http://shop/", nil)
+	r.Header.Set("X-Request-ID", "client-id")
+	w = httptest.NewRecorder()
+	ps.Handler(w, r)
+	if received != "client-id" || w.Header().Get("X-Request-ID") != "client-id" {
+		t.Errorf("Expected the client id to be kept, got %q sent and %q echoed", received, w.Header().Get("X-Request-ID"))
+	}
+
+	r = httptest.NewRequest("GET", "http://shop/", nil)
+	r.Header.Set("X-Request-ID", "not valid\n")
+	w = httptest.NewRecorder()
+	ps.Handler(w, r)
+	if received == "not valid\n" || len(received) != 32 {
+		t.Errorf("Expected an invalid client id to be replaced, got %q", received)
+	}
+}
+
+func TestRequestIDInErrorResponse(t *testing.T) {
+	r, info := withRequestInfo(httptest.NewRequest("GET", "http://shop/", nil))
+	info.RequestID = "failing-id"
+	resp := errorResponse(r, http.StatusBadGateway, "Proxy error")
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.Header.Get("X-Request-ID") != "failing-id" || !strings.Contains(string(body), "Request ID: failing-id") {
+		t.Errorf("Expected the request id in the error response, got %v %q", resp.Header, body)
+	}
+}
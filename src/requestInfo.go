@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+type contextKey int
+
+const requestInfoKey contextKey = iota
+
+// RequestInfo carries what the proxy learned about a request while handling
+// it, so wrapping handlers (like the inspector) can report on it afterwards.
+type RequestInfo struct {
+	// RequestID is the X-Request-ID of the request
+	RequestID   string
+	Destination string
+	// Route describes the route the request matched, RouteName names it
+	Route     string
+	RouteName string
+	// Stack is the stack picked when the deployment is split between stacks
+	Stack string
+	// Endpoints are the endpoints the destination could have been balanced
+	// to, retries move on to one not tried yet
+	Endpoints []string
+	// Retries counts the attempts made after the first one
+	Retries int
+	// UpstreamLatency is how long the backend took to answer, retries
+	// included, or to accept the connection of a websocket
+	UpstreamLatency time.Duration
+	// WebsocketBytesIn and Out count the bytes of a websocket session, from
+	// and to the client
+	WebsocketBytesIn  int64
+	WebsocketBytesOut int64
+
+	// PinnedDestination bypasses the destination resolver, which is how the
+	// inspector replays a request against the backend that originally served it.
+	PinnedDestination string
+}
+
+// withRequestInfo attaches a RequestInfo to the request, unless one is already
+// present, and returns the request to pass on.
+func withRequestInfo(r *http.Request) (*http.Request, *RequestInfo) {
+	if info, ok := r.Context().Value(requestInfoKey).(*RequestInfo); ok {
+		return r, info
+	}
+	info := &RequestInfo{}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey, info)), info
+}
+
+// requestInfo returns the RequestInfo attached to the request. When nobody
+// asked for it, a throwaway value is returned so callers never have to check.
+func requestInfo(r *http.Request) *RequestInfo {
+	if info, ok := r.Context().Value(requestInfoKey).(*RequestInfo); ok {
+		return info
+	}
+	return &RequestInfo{}
+}
@@ -0,0 +1,414 @@
+package resolver
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// labelWeight on the services of a stack sets the share of the traffic of
+// its deployment the stack gets, in percent. The newest healthy stack without
+// a weight gets what is left, so labeling a new stack gateway.weight=10 sends
+// it 10% of the traffic while the current stack keeps serving the rest.
+const labelWeight = "gateway.weight"
+
+// DeploymentManager is implemented by resolvers that split the traffic of a
+// deployment between its stacks, and lets all of it be moved to one stack.
+type DeploymentManager interface {
+	Deployments() []DeploymentStatus
+	// Promote sends all the traffic to the stack, the newest one when empty
+	Promote(deployment, stack string) error
+	// Rollback sends all the traffic to the stack deployed before the one
+	// serving most of it
+	Rollback(deployment string) error
+	// Unpin returns to splitting the traffic by weight
+	Unpin(deployment string) error
+}
+
+// DeploymentStatus describes how the traffic of a deployment is split.
+type DeploymentStatus struct {
+	Name string `json:"name"`
+	// Active is the newest healthy stack, which serves the deployment when
+	// its traffic is not split, and Newest the last stack deployed
+	Active string        `json:"active,omitempty"`
+	Newest string        `json:"newest,omitempty"`
+	Pinned string        `json:"pinned,omitempty"`
+	Stacks []StackStatus `json:"stacks"`
+}
+
+type StackStatus struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+	Healthy   bool      `json:"healthy"`
+	// Weight is the share of the traffic the stack gets, in percent
+	Weight int `json:"weight"`
+}
+
+// split is the share of the traffic of a deployment a stack gets
+type split struct {
+	stack  string
+	weight int
+}
+
+// weight returns the weight the stack is labeled with
+func (s *Stack) weight() (int, bool) {
+	for _, service := range s.services {
+		value, found := service.Spec.Labels[labelWeight]
+		if !found {
+			continue
+		}
+		weight, err := strconv.Atoi(value)
+		if err != nil || weight < 0 || weight > 100 {
+			log.Printf("Ignoring invalid %s label '%s' of service %s", labelWeight, value, service.Spec.Name)
+			return 0, false
+		}
+		return weight, true
+	}
+	return 0, false
+}
+
+// byAge returns the names of the stacks, oldest first
+func (d *Deployment) byAge() []string {
+	names := []string{}
+	for name := range d.stacks {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := d.stacks[names[i]], d.stacks[names[j]]
+		if !a.CreatedAt().Equal(b.CreatedAt()) {
+			return a.CreatedAt().Before(b.CreatedAt())
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// serving tells whether the stack may get traffic, stacks count as healthy
+// without a health label
+func (s *Stack) serving() bool {
+	return s.healthLabel == "" || s.Healthy()
+}
+
+// splits returns how the traffic is shared between the stacks, oldest first.
+// Weights are looked up by stack name, then on the stack labels. Unhealthy
+// stacks get no traffic, unless none is healthy, in which case the newest
+// stack gets all of it. Without a health label every stack counts as healthy.
+func (d *Deployment) splits(weights map[string]int) []split {
+	healthy := []string{}
+	for _, name := range d.byAge() {
+		stack := d.stacks[name]
+		if stack.serving() {
+			healthy = append(healthy, name)
+		}
+	}
+	if len(healthy) == 0 {
+		if names := d.byAge(); len(names) > 0 {
+			return []split{{names[len(names)-1], 100}}
+		}
+		return nil
+	}
+
+	splits := []split{}
+	primary, weighted := -1, 0
+	for _, name := range healthy {
+		stack := d.stacks[name]
+		weight, found := weights[name]
+		if !found {
+			weight, found = stack.weight()
+		}
+		if !found {
+			primary = len(splits)
+			weight = 0
+		}
+		splits = append(splits, split{name, weight})
+		weighted += weight
+	}
+	if primary >= 0 && weighted < 100 {
+		splits[primary].weight = 100 - weighted
+	}
+
+	shares := []split{}
+	for _, s := range splits {
+		if s.weight > 0 {
+			shares = append(shares, s)
+		}
+	}
+	if len(shares) == 0 {
+		return []split{{healthy[len(healthy)-1], 100}}
+	}
+	return shares
+}
+
+// Splits returns the deployments shared between several stacks.
+func (s *Swarm) Splits() map[string][]split {
+	splits := map[string][]split{}
+	for name, deployment := range s.deployments {
+		deployment := deployment
+		if shares := deployment.splits(s.weights); len(shares) > 1 {
+			splits[name] = shares
+		}
+	}
+	return splits
+}
+
+// pickStack chooses the stack serving a client. Clients are spread over the
+// weights by hashing their identity, so each keeps its stack as long as the
+// weights stay the same, and raising the weight of a stack only moves the
+// clients it takes over.
+func pickStack(splits []split, client string) string {
+	total := 0
+	for _, s := range splits {
+		total += s.weight
+	}
+	h := fnv.New32a()
+	h.Write([]byte(client))
+	bucket := int(h.Sum32() % uint32(total))
+	for _, s := range splits {
+		if bucket < s.weight {
+			return s.stack
+		}
+		bucket -= s.weight
+	}
+	return splits[len(splits)-1].stack
+}
+
+// clientKey identifies the client a request comes from: the sticky cookie
+// when set, else the client ip. X-Forwarded-For is only believed when the
+// request comes from a trusted proxy, clients could pick their stack with it
+// otherwise.
+func clientKey(r *http.Request, cookie string, trusted []*net.IPNet) string {
+	if cookie != "" {
+		if c, err := r.Cookie(cookie); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	// the proxies append the address they got the request from, the client
+	// is the last one not added by a trusted proxy
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for n := len(forwarded) - 1; n >= 0 && isTrusted(client, trusted); n-- {
+		address := strings.TrimSpace(forwarded[n])
+		if address == "" {
+			break
+		}
+		client = address
+	}
+	return client
+}
+
+func isTrusted(address string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses comma separated ips and CIDR networks.
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			if ip := net.ParseIP(field); ip != nil && ip.To4() != nil {
+				field += "/32"
+			} else {
+				field += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid trusted proxy '%s': %v", field, err))
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// splitsOf returns how the traffic of the deployment is shared, nil when a
+// single stack serves it.
+func (d *Docker) splitsOf(routing *routing, deployment string) []split {
+	d.pinMu.Lock()
+	pinned := d.pins[deployment]
+	d.pinMu.Unlock()
+	if pinned != "" {
+		if _, found := routing.swarm.deployments[deployment].stacks[pinned]; found {
+			return []split{{pinned, 100}}
+		}
+	}
+	return routing.splits[deployment]
+}
+
+// destination returns the endpoints of the name:port target. When the target
+// is a deployment split between stacks, the stack is picked for the client
+// of the request; without a request the endpoints of all stacks are returned.
+func (d *Docker) destination(routing *routing, route *Route, target string, r *http.Request) (Destination, bool) {
+	name, port, _ := net.SplitHostPort(target)
+	splits := d.splitsOf(routing, name)
+	if len(splits) == 0 {
+		endpoints, ok := d.endpoints(routing, target)
+		if !ok {
+			return Destination{}, false
+		}
+		return newDestination(route, endpoints...), true
+	}
+
+	if r == nil {
+		all := []string{}
+		for _, s := range splits {
+			endpoints, _ := d.endpoints(routing, net.JoinHostPort(s.stack, port))
+			all = append(all, endpoints...)
+		}
+		if len(all) == 0 {
+			return Destination{}, false
+		}
+		return newDestination(route, all...), true
+	}
+
+	stack := pickStack(splits, clientKey(r, d.stickyCookie, d.trustedProxies))
+	endpoints, ok := d.endpoints(routing, net.JoinHostPort(stack, port))
+	if !ok {
+		return Destination{}, false
+	}
+	destination := newDestination(route, endpoints...)
+	destination.Stack = stack
+	return destination, true
+}
+
+func (d *Docker) Deployments() []DeploymentStatus {
+	routing := d.currentRouting()
+	statuses := []DeploymentStatus{}
+	for name, deployment := range routing.swarm.deployments {
+		deployment := deployment
+		status := DeploymentStatus{Name: name, Stacks: []StackStatus{}}
+		weights := map[string]int{}
+		splits := d.splitsOf(routing, name)
+		if len(splits) == 0 {
+			splits = deployment.splits(routing.swarm.weights)
+		}
+		for _, s := range splits {
+			weights[s.stack] = s.weight
+		}
+		d.pinMu.Lock()
+		status.Pinned = d.pins[name]
+		d.pinMu.Unlock()
+		for _, stackName := range deployment.byAge() {
+			stack := deployment.stacks[stackName]
+			if stack.serving() {
+				status.Active = stackName
+			}
+			status.Newest = stackName
+			status.Stacks = append(status.Stacks, StackStatus{
+				Name:      stackName,
+				CreatedAt: stack.CreatedAt(),
+				Healthy:   stack.Healthy(),
+				Weight:    weights[stackName],
+			})
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+func (d *Docker) deployment(name string) (Deployment, error) {
+	deployment, found := d.currentRouting().swarm.deployments[name]
+	if !found {
+		return Deployment{}, errors.New(fmt.Sprintf("Unknown deployment '%s'", name))
+	}
+	return deployment, nil
+}
+
+func (d *Docker) pin(deployment, stack string) {
+	d.pinMu.Lock()
+	defer d.pinMu.Unlock()
+	if d.pins == nil {
+		d.pins = map[string]string{}
+	}
+	if stack == "" {
+		delete(d.pins, deployment)
+		log.Printf("Deployment %s is split by weight again", deployment)
+		return
+	}
+	d.pins[deployment] = stack
+	log.Printf("Deployment %s is pinned to stack %s", deployment, stack)
+}
+
+func (d *Docker) Promote(name, stack string) error {
+	deployment, err := d.deployment(name)
+	if err != nil {
+		return err
+	}
+	if stack == "" {
+		names := deployment.byAge()
+		stack = names[len(names)-1]
+	}
+	if _, found := deployment.stacks[stack]; !found {
+		return errors.New(fmt.Sprintf("Unknown stack '%s' in deployment '%s'", stack, name))
+	}
+	d.pin(name, stack)
+	return nil
+}
+
+func (d *Docker) Rollback(name string) error {
+	deployment, err := d.deployment(name)
+	if err != nil {
+		return err
+	}
+	serving := ""
+	splits := d.splitsOf(d.currentRouting(), name)
+	if len(splits) == 0 {
+		splits = deployment.splits(d.currentRouting().swarm.weights)
+	}
+	for _, s := range splits {
+		if serving == "" || s.weight >= weightOf(splits, serving) {
+			serving = s.stack
+		}
+	}
+	previous := ""
+	for _, stackName := range deployment.byAge() {
+		if stackName == serving {
+			break
+		}
+		previous = stackName
+	}
+	if previous == "" {
+		return errors.New(fmt.Sprintf("No stack deployed before '%s' in deployment '%s'", serving, name))
+	}
+	d.pin(name, previous)
+	return nil
+}
+
+func weightOf(splits []split, stack string) int {
+	for _, s := range splits {
+		if s.stack == stack {
+			return s.weight
+		}
+	}
+	return 0
+}
+
+func (d *Docker) Unpin(name string) error {
+	if _, err := d.deployment(name); err != nil {
+		return err
+	}
+	d.pin(name, "")
+	return nil
+}
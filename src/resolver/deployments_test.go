@@ -0,0 +1,205 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+func splitDocker(weights map[string]int, services ...swarm.Service) *Docker {
+	d := &Docker{
+		gatewayIp:    "gateway",
+		stickyCookie: "session",
+		swarm:        Swarm{deploymentLabel: "gateway.deployment", healthLabel: "gateway.healthy", weights: weights},
+	}
+	d.SetRoutes(ParseProxyMappings("shop"))
+	d.publish(d.newRouting(nil, services))
+	return d
+}
+
+func stackService(stack string, port uint32, created time.Time, labels ...string) swarm.Service {
+	service := testService(stack, 80, port)
+	service.CreatedAt = created
+	service.Spec.Labels["gateway.deployment"] = "shop"
+	service.Spec.Labels["gateway.healthy"] = "true"
+	for i := 0; i+1 < len(labels); i += 2 {
+		service.Spec.Labels[labels[i]] = labels[i+1]
+	}
+	return service
+}
+
+func TestDeploymentSplits(t *testing.T) {
+	created := time.Now().Add(-time.Hour)
+	for _, test := range []struct {
+		description string
+		weights     map[string]int
+		services    []swarm.Service
+		splits      []split
+	}{
+		{"the newest healthy stack serves everything", nil, []swarm.Service{
+			stackService("shop_v1", 8001, created),
+			stackService("shop_v2", 8002, created.Add(time.Minute)),
+		}, nil},
+		{"a labeled stack gets its weight", nil, []swarm.Service{
+			stackService("shop_v1", 8001, created),
+			stackService("shop_v2", 8002, created.Add(time.Minute), "gateway.weight", "20"),
+		}, []split{{"shop_v1", 80}, {"shop_v2", 20}}},
+		{"configured weights override labels", map[string]int{"shop_v2": 50}, []swarm.Service{
+			stackService("shop_v1", 8001, created),
+			stackService("shop_v2", 8002, created.Add(time.Minute), "gateway.weight", "20"),
+		}, []split{{"shop_v1", 50}, {"shop_v2", 50}}},
+		{"unhealthy stacks get no traffic", nil, []swarm.Service{
+			stackService("shop_v1", 8001, created),
+			stackService("shop_v2", 8002, created.Add(time.Minute), "gateway.weight", "20", "gateway.healthy", "false"),
+		}, nil},
+	} {
+		d := splitDocker(test.weights, test.services...)
+		if splits := d.currentRouting().splits["shop"]; !reflect.DeepEqual(splits, test.splits) {
+			t.Errorf("Expected %s, splitting %v, got: %v", test.description, test.splits, splits)
+		}
+	}
+}
+
+func TestDeploymentsWithoutHealthLabel(t *testing.T) {
+	created := time.Now().Add(-time.Hour)
+	d := &Docker{gatewayIp: "gateway", swarm: Swarm{deploymentLabel: "gateway.deployment"}}
+	d.publish(d.newRouting(nil, []swarm.Service{
+		stackService("shop_v1", 8001, created),
+		stackService("shop_v2", 8002, created.Add(time.Minute)),
+	}))
+
+	if status := d.Deployments(); len(status) != 1 || status[0].Active != "shop_v2" {
+		t.Errorf("Expected the newest stack to be reported active without a health label, got: %+v", status)
+	}
+}
+
+func TestSplitDeploymentResolve(t *testing.T) {
+	created := time.Now().Add(-time.Hour)
+	d := splitDocker(nil,
+		stackService("shop_v1", 8001, created),
+		stackService("shop_v2", 8002, created.Add(time.Minute), "gateway.weight", "20"),
+	)
+
+	stacks := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		r := HostRequest("shop", "/")
+		r.RemoteAddr = fmt.Sprintf("10.0.%d.%d:40000", i/250, i%250)
+		destination, err := d.Resolve(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stacks[destination.Stack]++
+		if again, _ := d.Resolve(r); again.HostPort != destination.HostPort {
+			t.Errorf("Expected %s to stay on %s, got: %s", r.RemoteAddr, destination.HostPort, again.HostPort)
+		}
+	}
+	if stacks["shop_v2"] < 150 || stacks["shop_v2"] > 250 || stacks["shop_v1"]+stacks["shop_v2"] != 1000 {
+		t.Errorf("Expected about 20%% of the clients on shop_v2, got: %v", stacks)
+	}
+
+	// the sticky cookie identifies the client whatever its ip
+	picked := ""
+	for i := 0; i < 20; i++ {
+		r := HostRequest("shop", "/")
+		r.RemoteAddr = fmt.Sprintf("10.1.0.%d:40000", i)
+		r.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+		destination, _ := d.Resolve(r)
+		if picked != "" && destination.Stack != picked {
+			t.Errorf("Expected the session to stay on %s, got: %s", picked, destination.Stack)
+		}
+		picked = destination.Stack
+	}
+
+	destinations := d.Destinations()
+	if len(destinations) != 1 || !reflect.DeepEqual(destinations[0].Endpoints, []string{"gateway:8001", "gateway:8002"}) {
+		t.Errorf("Expected the endpoints of both stacks to be checked, got: %v", destinations)
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		remoteAddr, forwarded, cookie string
+		trusted                       []*net.IPNet
+		key                           string
+	}{
+		{"203.0.113.7:40000", "", "", nil, "203.0.113.7"},
+		{"203.0.113.7:40000", "198.51.100.1", "", nil, "203.0.113.7"},
+		{"203.0.113.7:40000", "198.51.100.1", "", trusted, "203.0.113.7"},
+		{"10.0.0.2:40000", "198.51.100.1", "", trusted, "198.51.100.1"},
+		// addresses before the last untrusted one are the client's own say
+		{"10.0.0.2:40000", "1.1.1.1, 198.51.100.1, 192.168.1.1", "", trusted, "198.51.100.1"},
+		{"10.0.0.2:40000", "", "", trusted, "10.0.0.2"},
+		{"10.0.0.2:40000", "198.51.100.1", "abc", trusted, "abc"},
+	} {
+		r := HostRequest("shop", "/")
+		r.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if test.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "session", Value: test.cookie})
+		}
+		if key := clientKey(r, "session", test.trusted); key != test.key {
+			t.Errorf("Expected %+v to be identified as %s, got %s", test, test.key, key)
+		}
+	}
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("Expected invalid networks to be rejected")
+	}
+}
+
+func TestPromoteAndRollback(t *testing.T) {
+	created := time.Now().Add(-time.Hour)
+	d := splitDocker(nil,
+		stackService("shop_v1", 8001, created),
+		stackService("shop_v2", 8002, created.Add(time.Minute), "gateway.weight", "20"),
+	)
+	served := func() map[string]bool {
+		stacks := map[string]bool{}
+		for i := 0; i < 100; i++ {
+			r := HostRequest("shop", "/")
+			r.RemoteAddr = fmt.Sprintf("10.0.0.%d:40000", i)
+			destination, _ := d.Resolve(r)
+			stacks[destination.HostPort] = true
+		}
+		return stacks
+	}
+
+	if err := d.Promote("shop", ""); err != nil {
+		t.Fatal(err)
+	}
+	if stacks := served(); !reflect.DeepEqual(stacks, map[string]bool{"gateway:8002": true}) {
+		t.Errorf("Expected the newest stack to serve everything once promoted, got: %v", stacks)
+	}
+	if err := d.Rollback("shop"); err != nil {
+		t.Fatal(err)
+	}
+	if stacks := served(); !reflect.DeepEqual(stacks, map[string]bool{"gateway:8001": true}) {
+		t.Errorf("Expected the previous stack to serve everything once rolled back, got: %v", stacks)
+	}
+	if err := d.Rollback("shop"); err == nil {
+		t.Errorf("Expected no rollback past the oldest stack")
+	}
+	if status := d.Deployments(); len(status) != 1 || status[0].Pinned != "shop_v1" || status[0].Stacks[0].Weight != 100 {
+		t.Errorf("Expected the deployment to be reported pinned to shop_v1, got: %+v", status)
+	}
+
+	if err := d.Unpin("shop"); err != nil {
+		t.Fatal(err)
+	}
+	if stacks := served(); len(stacks) != 2 {
+		t.Errorf("Expected the traffic to be split again once unpinned, got: %v", stacks)
+	}
+	if d.Promote("cart", "") == nil || d.Promote("shop", "shop_v3") == nil {
+		t.Errorf("Expected unknown deployments and stacks to be rejected")
+	}
+}
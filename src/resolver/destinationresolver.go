@@ -3,6 +3,8 @@ package resolver
 import (
 	"fmt"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"syscall"
 )
@@ -10,7 +12,44 @@ import (
 type DestinationResolver interface {
 	Configure()
 	GetName() string
-	GetDestinationHostPort(srcHostPort string) (dstHostPort string, err error)
+	// Resolve returns where the request should be proxied to
+	Resolve(r *http.Request) (Destination, error)
+	// SetRoutes replaces the configured routes while the resolver is in use
+	SetRoutes(routes []Route)
+	// Destinations returns the destination of every route, so their
+	// endpoints can be health checked
+	Destinations() []Destination
+}
+
+// Resyncer is implemented by resolvers that discover their destinations,
+// and can be asked to look again at once.
+type Resyncer interface {
+	Resync()
+}
+
+// PortMapper is implemented by resolvers routing to published ports. It
+// returns the published ports by name:port.
+type PortMapper interface {
+	PortMappings() map[string][]uint16
+}
+
+// HostRouter is implemented by resolvers that can tell whether they route a
+// hostname before any request for it comes in, which is what certificates
+// are requested for.
+type HostRouter interface {
+	Routable(host string) bool
+}
+
+// ClientCertRouter is implemented by resolvers that can tell whether a host
+// has a route requiring a client certificate, which is asked for during the
+// handshake, before any request.
+type ClientCertRouter interface {
+	WantsClientCert(host string) bool
+}
+
+// HostRequest is the request resolved when only the host is known
+func HostRequest(host, path string) *http.Request {
+	return &http.Request{Method: "GET", Host: host, URL: &url.URL{Path: path}, Header: http.Header{}}
 }
 
 func exitWithError(err error) {
@@ -18,32 +57,39 @@ func exitWithError(err error) {
 	os.Exit(1)
 }
 
-func gatewayIp() string {
+// gatewayIp finds the address of the Docker host, where published ports are
+// reachable from within a container. Unless Docker Desktop provides
+// host.docker.internal, it is the first hop of a traceroute, which needs a
+// raw socket (NET_RAW).
+func gatewayIp() (string, error) {
 	ips, _ := net.LookupIP("host.docker.internal")
 	if len(ips) > 0 {
-		return "host.docker.internal"
+		return "host.docker.internal", nil
 	}
 	cli, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
 	if err != nil {
-		exitWithError(err)
+		return "", err
 	}
 	defer syscall.Close(cli)
 	srv, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_ICMP)
 	if err != nil {
-		exitWithError(err)
+		return "", err
 	}
 	defer syscall.Close(srv)
 
 	ttl := 1
 	if err := syscall.SetsockoptInt(cli, syscall.SOL_IP, syscall.IP_TTL, ttl); err != nil {
-		exitWithError(err)
+		return "", err
 	}
 	addr := &syscall.SockaddrInet4{Port: 33333, Addr: [4]byte{8, 8, 8, 8}}
 	if err := syscall.Sendto(cli, []byte{}, 0, addr); err != nil {
-		exitWithError(err)
+		return "", err
 	}
 
-	_, from, _ := syscall.Recvfrom(srv, []byte{}, 0)
+	_, from, err := syscall.Recvfrom(srv, []byte{}, 0)
+	if err != nil {
+		return "", err
+	}
 	b := from.(*syscall.SockaddrInet4).Addr
-	return fmt.Sprintf("%v.%v.%v.%v", b[0], b[1], b[2], b[3])
+	return fmt.Sprintf("%v.%v.%v.%v", b[0], b[1], b[2], b[3]), nil
 }
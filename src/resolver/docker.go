@@ -5,9 +5,15 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"net/http"
+	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/docker/docker/api/types"
@@ -52,14 +58,16 @@ func (s *Stack) Namespace(label string) string {
 	return namespace
 }
 
-func (s *Stack) Ports() map[uint32]uint32 {
-	ports := map[uint32]uint32{}
+// Ports returns the published ports of each target port, one per service
+// exposing it.
+func (s *Stack) Ports() map[uint32][]uint32 {
+	ports := map[uint32][]uint32{}
 	for _, service := range s.services {
 		for _, port := range service.Endpoint.Ports {
 			if port.Protocol != "tcp" {
 				continue
 			}
-			ports[port.TargetPort] = port.PublishedPort
+			ports[port.TargetPort] = append(ports[port.TargetPort], port.PublishedPort)
 		}
 	}
 	return ports
@@ -71,6 +79,7 @@ type Deployment struct {
 
 func (d *Deployment) ActiveStack() (activeStack *Stack) {
 	for _, stack := range d.stacks {
+		stack := stack
 		if !stack.Healthy() {
 			continue
 		}
@@ -86,6 +95,7 @@ func (d *Deployment) ActiveStack() (activeStack *Stack) {
 }
 func (d *Deployment) NewestStack() (newestStack *Stack) {
 	for _, stack := range d.stacks {
+		stack := stack
 		if newestStack == nil {
 			newestStack = &stack
 			continue
@@ -101,9 +111,15 @@ type Swarm struct {
 	deployments     map[string]Deployment
 	deploymentLabel string
 	healthLabel     string
+	// weights set the share of traffic of stacks by name, over their
+	// gateway.weight label
+	weights map[string]int
 }
 
-func (s *Swarm) AddServices(services []swarm.Service) {
+// WithServices returns a copy of the swarm holding the deployments built from
+// the given services. The receiver is left untouched, so a published swarm
+// can be read while the next one is built.
+func (s Swarm) WithServices(services []swarm.Service) Swarm {
 	stacks := map[string]Stack{}
 	for _, service := range services {
 		stackName := service.Spec.Labels["com.docker.stack.namespace"]
@@ -122,57 +138,227 @@ func (s *Swarm) AddServices(services []swarm.Service) {
 		deployment.stacks[name] = stack
 		s.deployments[namespace] = deployment
 	}
+	return s
 }
-func (s *Swarm) Ports() map[string]uint16 {
-	ports := map[string]uint16{}
+
+// Ports returns the published ports of the stack serving each deployment by
+// deployment:port, and of every stack by stack:port, which is where requests
+// go when the deployment is split between stacks.
+func (s *Swarm) Ports() map[string][]uint16 {
+	ports := map[string][]uint16{}
 	for name, deployment := range s.deployments {
 		stack := deployment.ActiveStack()
 		if stack == nil {
 			stack = deployment.NewestStack()
 		}
-		for targetPort, publishedPort := range stack.Ports() {
-			ports[fmt.Sprintf("%s:%d", name, targetPort)] = uint16(publishedPort)
+		for targetPort, publishedPorts := range stack.Ports() {
+			for _, publishedPort := range publishedPorts {
+				addPort(ports, fmt.Sprintf("%s:%d", name, targetPort), uint16(publishedPort))
+			}
+		}
+		for stackName, stack := range deployment.stacks {
+			for targetPort, publishedPorts := range stack.Ports() {
+				for _, publishedPort := range publishedPorts {
+					addPort(ports, fmt.Sprintf("%s:%d", stackName, targetPort), uint16(publishedPort))
+				}
+			}
 		}
 	}
 	return ports
 }
 
+// Addresses returns the virtual ips of the services of the stack serving
+// each deployment, on the given networks, and of every stack like Ports. A
+// deployment with a single service is reachable on any port by its name
+// alone, otherwise only on the target ports of its services.
+func (s *Swarm) Addresses(networks map[string]bool) map[string][]string {
+	addresses := map[string][]string{}
+	for name, deployment := range s.deployments {
+		stack := deployment.ActiveStack()
+		if stack == nil {
+			stack = deployment.NewestStack()
+		}
+		stack.addAddresses(addresses, name, networks)
+		for stackName, stack := range deployment.stacks {
+			stack.addAddresses(addresses, stackName, networks)
+		}
+	}
+	return addresses
+}
+
+// addAddresses adds the virtual ips of the services of the stack under name
+func (s *Stack) addAddresses(addresses map[string][]string, name string, networks map[string]bool) {
+	for _, service := range s.services {
+		ip := serviceAddress(service, networks)
+		if ip == "" {
+			continue
+		}
+		if len(s.services) == 1 {
+			addAddress(addresses, name, ip)
+		}
+		for _, port := range service.Endpoint.Ports {
+			if port.Protocol == "tcp" {
+				addAddress(addresses, fmt.Sprintf("%s:%d", name, port.TargetPort), ip)
+			}
+		}
+	}
+}
+
+// serviceAddress returns the virtual ip of the service on one of the networks
+func serviceAddress(service swarm.Service, networks map[string]bool) string {
+	for _, vip := range service.Endpoint.VirtualIPs {
+		if !networks[vip.NetworkID] {
+			continue
+		}
+		ip, _, err := net.ParseCIDR(vip.Addr)
+		if err != nil {
+			continue
+		}
+		return ip.String()
+	}
+	return ""
+}
+
+// DockerAPI is the part of the Docker engine API the resolver depends on. It
+// is satisfied by *client.Client, and by an in-memory fake in the tests.
+type DockerAPI interface {
+	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+	ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error)
+	Info(ctx context.Context) (types.Info, error)
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+}
+
+// routing is a snapshot of the running containers and services. Docker
+// events are handled on their own goroutine while every request looks up its
+// destination, so a snapshot is never modified once published; each refresh
+// builds and publishes a new one.
+type routing struct {
+	// portMappings holds the published ports by name:port, one per replica
+	portMappings map[string][]uint16
+	// addresses holds the ips of containers and services on a network shared
+	// with the gateway, by name:port and by name alone
+	addresses map[string][]string
+	swarm     Swarm
+	// splits hold how the traffic of deployments is shared between stacks,
+	// for those served by more than one
+	splits map[string][]split
+	// routes are the routes labeled on containers and services
+	routes *routeTable
+}
+
+// Routes returns the routes labeled on the services of the stack serving
+// each deployment, so label changes follow the active stack.
+func (s *Swarm) Routes() []Route {
+	routes := []Route{}
+	for name, deployment := range s.deployments {
+		stack := deployment.ActiveStack()
+		if stack == nil {
+			stack = deployment.NewestStack()
+		}
+		for _, service := range stack.services {
+			if service.Spec.Labels[labelHost] == "" {
+				continue
+			}
+			ports := []uint16{}
+			for _, port := range service.Endpoint.Ports {
+				if port.Protocol == "tcp" {
+					ports = append(ports, uint16(port.TargetPort))
+				}
+			}
+			routes = append(routes, labelRoutes(service.Spec.Labels, name, ports)...)
+		}
+	}
+	return routes
+}
+
 type Docker struct {
+	// Routes are proxied in addition to the proxy-mappings flag
+	Routes []Route
+	// Weights set the share of the traffic of stacks by name, in percent
+	Weights map[string]int
+
+	routeStore
 	proxyOnlyMappedHosts bool
-	proxyMappings        map[string]string
-	portMappings         map[string]uint16
-	innerPorts           map[string]uint16
+	routing              atomic.Value
+	refreshMu            sync.Mutex
 	stackSearchString    string
-	baseHostname         string
-	gatewayIp            string
-	client               *client.Client
-	info                 types.Info
+	// stackSearch is compiled from stackSearchString when configured
+	stackSearch  *regexp.Regexp
+	baseHostname string
+	gatewayIp    string
+	// networkRouting routes to the address of containers on the networks
+	// shared with the gateway, rather than to their published ports
+	networkRouting bool
+	networks       string
+	hostname       string
+	client         DockerAPI
+	info           types.Info
 
 	stackLabel  string
 	healthLabel string
-	swarm       Swarm
+	// swarm holds the labels to group services by, the deployments found are
+	// part of the published routing
+	swarm Swarm
+	// stickyCookie identifies clients to keep on the same stack, over their ip
+	stickyCookie string
+	// trustedProxies are the proxies whose X-Forwarded-For tells the
+	// client ip
+	trustedProxies     []*net.IPNet
+	trustedProxiesFlag string
+	pinMu              sync.Mutex
+	// pins hold the stack serving all the traffic of a deployment, by name
+	pins map[string]string
 }
 
 func (d *Docker) Configure() {
 	flag.BoolVar(&d.proxyOnlyMappedHosts, "proxy-only-mapped-hosts", false, "Only hosts specified in proxy mapping will be proxied")
 	flag.StringVar(&d.baseHostname, "base-hostname", "", "Proxy key is first subdomaine to base host")
-	flag.StringVar(&d.gatewayIp, "gateway-ip", gatewayIp(), "Specify gateway ip")
+	flag.StringVar(&d.gatewayIp, "gateway-ip", "", "Specify gateway ip (detected when empty)")
 	flag.StringVar(&d.stackSearchString, "stack-search-string", "([^\\.]+)\\.(local|dev|build|test|stage|preprod|prod)\\.", "How to identify a stack from hostname")
 	flag.StringVar(&d.stackLabel, "docker-stack-label", "", "Name of label defining the stack")
 	flag.StringVar(&d.healthLabel, "docker-health-label", "", "Name of label specifing the service health")
+	flag.BoolVar(&d.networkRouting, "docker-network-routing", false, "Route to container ips on the networks shared with the gateway, falling back to published ports")
+	flag.StringVar(&d.networks, "docker-networks", "", "Comma separated networks to route over (defaults to the networks of the gateway container)")
 
-	var mappings string
-	flag.StringVar(&mappings, "proxy-mappings", "", "Manually specify mappings")
+	flag.StringVar(&d.stickyCookie, "docker-sticky-cookie", "", "Name of the cookie keeping clients on the same stack of a split deployment")
+	flag.StringVar(&d.trustedProxiesFlag, "docker-trusted-proxies", "", "Comma separated ips or networks of the proxies in front of the gateway, whose X-Forwarded-For identifies clients of a split deployment")
+	flag.StringVar(&d.mappings, "proxy-mappings", "", "Manually specify mappings")
 	flag.Parse()
 
-	d.proxyMappings, d.innerPorts = d.parseProxyMappings(mappings)
-
-	var err error
-	d.client, err = client.NewClientWithOpts(client.WithVersion("1.30")) //1.18
+	if d.gatewayIp == "" {
+		ip, err := gatewayIp()
+		if err != nil && !d.networkRouting {
+			exitWithError(err)
+		}
+		if err != nil {
+			log.Printf("Unable to find the gateway ip, published ports will not be routed to: %v", err)
+		}
+		d.gatewayIp = ip
+	}
+	if d.hostname == "" {
+		d.hostname, _ = os.Hostname()
+	}
+	stackSearch, err := regexp.Compile(d.stackSearchString)
+	if err != nil {
+		exitWithError(errors.New(fmt.Sprintf("Invalid stack-search-string '%s': %v", d.stackSearchString, err)))
+	}
+	d.stackSearch = stackSearch
+	trusted, err := parseTrustedProxies(d.trustedProxiesFlag)
 	if err != nil {
-		panic(err)
+		exitWithError(err)
 	}
-	d.swarm = Swarm{deploymentLabel: d.stackLabel, healthLabel: d.healthLabel}
+	d.trustedProxies = trusted
+
+	d.SetRoutes(d.Routes)
+
+	if d.client == nil {
+		var err error
+		d.client, err = client.NewClientWithOpts(client.WithVersion("1.30")) //1.18
+		if err != nil {
+			panic(err)
+		}
+	}
+	d.swarm = Swarm{deploymentLabel: d.stackLabel, healthLabel: d.healthLabel, weights: d.Weights}
 
 	d.fetchPorts()
 	go d.listenEvents()
@@ -183,29 +369,6 @@ func (d *Docker) GetName() string {
 	return "docker"
 }
 
-func (d *Docker) parseProxyMappings(mappings string) (map[string]string, map[string]uint16) {
-	proxyMap := make(map[string]string)
-	innerPorts := make(map[string]uint16)
-	for _, mapping := range strings.Fields(mappings) {
-		hhp := strings.Split(mapping, ":")
-
-		if _, err := strconv.Atoi(hhp[len(hhp)-1]); err != nil {
-			hhp = append(hhp, "80")
-		}
-		if len(hhp) > 3 {
-			log.Printf("Wrong mapping format '%s' expected [srchost:]dsthost[:destport]", mapping)
-			continue
-		}
-		if len(hhp) == 2 {
-			hhp = []string{hhp[0], hhp[0], hhp[1]}
-		}
-		proxyMap[hhp[0]] = fmt.Sprintf("%s:%s", hhp[1], hhp[2])
-		innerPort, _ := strconv.Atoi(hhp[2])
-		innerPorts[hhp[1]] = uint16(innerPort)
-	}
-	return proxyMap, innerPorts
-}
-
 func (d *Docker) listenEvents() {
 	filters := filters.NewArgs()
 	// Include specific event types
@@ -223,40 +386,94 @@ func (d *Docker) listenEvents() {
 			}
 			return
 		case e := <-messages:
-			// Exclude specific actions
-			if e.Action == "health_status" {
-				break
-			}
-			if strings.HasPrefix(e.Action, "exec_") {
+			// Exclude specific actions, health events come as "health_status: healthy"
+			if strings.HasPrefix(e.Action, "health_status") || strings.HasPrefix(e.Action, "exec_") {
+				dockerEvents.WithLabelValues(e.Type, "false").Inc()
 				break
 			}
 
+			dockerEvents.WithLabelValues(e.Type, "true").Inc()
 			fmt.Printf("Refreshing port mapping [%s] %s: ", e.Type, e.Action)
 			d.fetchPorts()
 		}
 	}
 }
 
-func (d *Docker) fetchContainerPorts() map[string]uint16 {
-	portMappings := make(map[string]uint16)
-
+func (d *Docker) fetchContainers() []types.Container {
 	containers, err := d.client.ContainerList(context.Background(), types.ContainerListOptions{})
 	if err != nil {
 		log.Println(err)
-		return portMappings
+		return nil
+	}
+	return containers
+}
+
+func (d *Docker) fetchServices() []swarm.Service {
+	services, err := d.client.ServiceList(context.Background(), types.ServiceListOptions{})
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return services
+}
+
+// containerNames returns the names a container is routed by: its
+// gateway.stack.name label, or its names trimmed of each _suffix in turn
+// (web_stack_1, web_stack and web), and its service name.
+func containerNames(container types.Container) []string {
+	if container.Labels["gateway.stack.name"] != "" {
+		return []string{container.Labels["gateway.stack.name"]}
 	}
+	names := []string{}
+	for _, name := range container.Names {
+		for i := len(name); i > -1; i = strings.LastIndex(name, "_") {
+			name = name[0:i]
+			names = append(names, name[1:])
+		}
+	}
+	// compose names its replicas project-service-1 since v2
+	service := serviceName(container)
+	for _, name := range names {
+		if name == service {
+			return names
+		}
+	}
+	if service != "" {
+		names = append(names, service)
+	}
+	return names
+}
+
+// serviceName returns the name the replicas of a scaled service share: the
+// container name without its replica number, web_1 and web-2 being replicas
+// of web.
+func serviceName(container types.Container) string {
+	if container.Labels["gateway.stack.name"] != "" {
+		return container.Labels["gateway.stack.name"]
+	}
+	if len(container.Names) == 0 {
+		return ""
+	}
+	name := strings.TrimPrefix(container.Names[0], "/")
+	i := strings.LastIndexAny(name, "_-")
+	if i < 1 {
+		return name
+	}
+	if _, err := strconv.Atoi(name[i+1:]); err != nil {
+		return name
+	}
+	return name[:i]
+}
+
+// containerPorts returns the published ports by name:port. Replicas share
+// their trimmed names, so scaled services get one port per container.
+func containerPorts(containers []types.Container) map[string][]uint16 {
+	portMappings := make(map[string][]uint16)
 	for _, container := range containers {
 		for _, port := range container.Ports {
 			if port.Type == "tcp" && port.PublicPort > 0 {
-				if container.Labels["gateway.stack.name"] != "" {
-					portMappings[fmt.Sprintf("%s:%d", container.Labels["gateway.stack.name"], port.PrivatePort)] = port.PublicPort
-					continue
-				}
-				for _, name := range container.Names {
-					for i := len(name); i > -1; i = strings.LastIndex(name, "_") {
-						name = name[0:i]
-						portMappings[fmt.Sprintf("%s:%d", name[1:], port.PrivatePort)] = port.PublicPort
-					}
+				for _, name := range containerNames(container) {
+					addPort(portMappings, fmt.Sprintf("%s:%d", name, port.PrivatePort), port.PublicPort)
 				}
 			}
 		}
@@ -264,61 +481,302 @@ func (d *Docker) fetchContainerPorts() map[string]uint16 {
 	return portMappings
 }
 
-func (d *Docker) fetchServicePorts() map[string]uint16 {
-	services, err := d.client.ServiceList(context.Background(), types.ServiceListOptions{})
-	if err != nil {
-		log.Println(err)
-		return map[string]uint16{}
+// addPort adds port to the ports of key, kept sorted so every snapshot lists
+// the replicas in the same order
+func addPort(ports map[string][]uint16, key string, port uint16) {
+	for _, existing := range ports[key] {
+		if existing == port {
+			return
+		}
+	}
+	ports[key] = append(ports[key], port)
+	sort.Slice(ports[key], func(i, j int) bool { return ports[key][i] < ports[key][j] })
+}
+
+// addAddress adds ip to the addresses of key, kept sorted as well
+func addAddress(addresses map[string][]string, key string, ip string) {
+	for _, existing := range addresses[key] {
+		if existing == ip {
+			return
+		}
+	}
+	addresses[key] = append(addresses[key], ip)
+	sort.Strings(addresses[key])
+}
+
+// containerAddresses returns the ip of the containers attached to one of the
+// networks, by name and by name:port for the ports they expose.
+func containerAddresses(containers []types.Container, networks map[string]bool) map[string][]string {
+	addresses := map[string][]string{}
+	for _, container := range containers {
+		if container.NetworkSettings == nil {
+			continue
+		}
+		ip := ""
+		for name, endpoint := range container.NetworkSettings.Networks {
+			if endpoint != nil && endpoint.IPAddress != "" && (networks[name] || networks[endpoint.NetworkID]) {
+				ip = endpoint.IPAddress
+				break
+			}
+		}
+		if ip == "" {
+			continue
+		}
+		for _, name := range containerNames(container) {
+			addAddress(addresses, name, ip)
+			for _, port := range container.Ports {
+				if port.Type == "tcp" {
+					addAddress(addresses, fmt.Sprintf("%s:%d", name, port.PrivatePort), ip)
+				}
+			}
+		}
 	}
-	d.swarm.AddServices(services)
-	return d.swarm.Ports()
+	return addresses
+}
+
+// sharedNetworks returns the names and ids of the networks to route over:
+// the docker-networks flag, or else the networks of the gateway container,
+// found by its hostname which Docker sets to the short container id.
+func (d *Docker) sharedNetworks(containers []types.Container) map[string]bool {
+	networks := map[string]bool{}
+	for _, name := range strings.Split(d.networks, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			networks[name] = true
+		}
+	}
+	for _, container := range containers {
+		if container.NetworkSettings == nil {
+			continue
+		}
+		self := d.hostname != "" && strings.HasPrefix(container.ID, d.hostname)
+		for name, endpoint := range container.NetworkSettings.Networks {
+			if endpoint == nil {
+				continue
+			}
+			// ids are needed to match the virtual ips of swarm services
+			if networks[name] || (self && d.networks == "") {
+				networks[name] = true
+				networks[endpoint.NetworkID] = true
+			}
+		}
+	}
+	return networks
+}
+
+// newRouting builds a routing snapshot from the containers and, in swarm
+// mode, the services currently running.
+func (d *Docker) newRouting(containers []types.Container, services []swarm.Service) *routing {
+	ports := containerPorts(containers)
+	sw := d.swarm.WithServices(services)
+	for k, v := range sw.Ports() {
+		ports[k] = v
+	}
+	routes := newRouteTable(append(containerRoutes(containers), sw.Routes()...))
+	addresses := map[string][]string{}
+	if d.networkRouting {
+		networks := d.sharedNetworks(containers)
+		addresses = containerAddresses(containers, networks)
+		for k, v := range sw.Addresses(networks) {
+			addresses[k] = v
+		}
+	}
+	return &routing{portMappings: ports, addresses: addresses, swarm: sw, splits: sw.Splits(), routes: routes}
 }
 
 func (d *Docker) fetchPorts() {
+	d.refreshMu.Lock()
+	defer d.refreshMu.Unlock()
+	dockerRefreshes.Inc()
+
 	info, _ := d.client.Info(context.Background())
 	fmt.Printf("Swarm mode: %+v\n", info.Swarm.ControlAvailable)
 
-	ports := d.fetchContainerPorts()
+	var services []swarm.Service
 	if info.Swarm.ControlAvailable {
-		for k, v := range d.fetchServicePorts() {
-			ports[k] = v
+		services = d.fetchServices()
+	}
+	r := d.newRouting(d.fetchContainers(), services)
+	previous := d.currentRouting()
+	d.publish(r)
+	fmt.Println(r.portMappings)
+	if d.networkRouting {
+		fmt.Println(r.addresses)
+	}
+	for _, line := range previous.routes.diff(r.routes) {
+		log.Println(line)
+	}
+}
+
+func (d *Docker) publish(r *routing) {
+	if r.routes == nil {
+		r.routes = newRouteTable(nil)
+	}
+	d.routing.Store(r)
+}
+
+func (d *Docker) currentRouting() *routing {
+	if r, ok := d.routing.Load().(*routing); ok {
+		return r
+	}
+	return &routing{portMappings: map[string][]uint16{}, addresses: map[string][]string{}, routes: newRouteTable(nil)}
+}
+
+// Resync refreshes the routing from the containers and services running now.
+func (d *Docker) Resync() {
+	d.fetchPorts()
+}
+
+func (d *Docker) PortMappings() map[string][]uint16 {
+	return d.currentRouting().portMappings
+}
+
+func (d *Docker) Resolve(r *http.Request) (Destination, error) {
+	return d.resolve(r)
+}
+
+// Destinations returns the configured and labeled routes that currently have
+// endpoints.
+func (d *Docker) Destinations() []Destination {
+	routing := d.currentRouting()
+	destinations := []Destination{}
+	for _, route := range append(d.routeTable().all(), routing.routes.all()...) {
+		if destination, ok := d.destination(routing, route, route.Target(), nil); ok {
+			destinations = append(destinations, destination)
 		}
 	}
+	return destinations
+}
 
-	d.portMappings = ports
-	fmt.Println(d.portMappings)
+// findStack returns the stack name the stack search finds in the host, and
+// what comes in front of the match.
+func (d *Docker) findStack(host string) (stack, prefix string, found bool) {
+	if d.stackSearch == nil {
+		return "", "", false
+	}
+	match := d.stackSearch.FindStringSubmatchIndex(host)
+	if len(match) < 4 || match[2] < 0 {
+		return "", "", false
+	}
+	return host[match[2]:match[3]], host[:match[0]], true
+}
+
+// Routable tells whether the host matches a configured or labeled route,
+// directly or through the stack its name contains, or else names a running
+// service.
+func (d *Docker) Routable(host string) bool {
+	host = strings.Split(host, ":")[0]
+	routing := d.currentRouting()
+	routed := func(name string) bool {
+		return d.routeTable().hasHost(name) || routing.routes.hasHost(name)
+	}
+	if routed(host) {
+		return true
+	}
+	// certificates are only wanted for one label in front of the stack, as
+	// in api.shop.dev.example.com, not for any number of them
+	if stack, prefix, found := d.findStack(host); found && !strings.Contains(strings.TrimSuffix(prefix, "."), ".") {
+		host = stack
+		if routed(host) {
+			return true
+		}
+	}
+	if d.proxyOnlyMappedHosts {
+		return false
+	}
+	_, ok := d.destination(routing, nil, host+":80", nil)
+	return ok
+}
+
+// WantsClientCert tells whether a configured or labeled route of the host,
+// or of the stack its name contains, requires a client certificate.
+func (d *Docker) WantsClientCert(host string) bool {
+	routing := d.currentRouting()
+	wants := func(name string) bool {
+		return d.routeTable().wantsClientCert(name) || routing.routes.wantsClientCert(name)
+	}
+	if wants(host) {
+		return true
+	}
+	stack, _, found := d.findStack(host)
+	return found && wants(stack)
 }
 
 func (d *Docker) GetDestinationHostPort(srcHostPort string) (dstHostPort string, err error) {
-	srcHost := strings.Split(srcHostPort, ":")[0]
+	destination, err := d.resolve(HostRequest(srcHostPort, "/"))
+	return destination.HostPort, err
+}
+
+// matchRoute looks the host up in the configured routes and in the routes
+// labeled on containers and services. Configured routes win ties.
+func (d *Docker) matchRoute(routing *routing, host string, r *http.Request) (*Route, bool) {
+	configured, found := d.routeTable().match(host, r)
+	labeled, labelFound := routing.routes.match(host, r)
+	if !labelFound {
+		return configured, found
+	}
+	if found {
+		configuredRank, _ := configured.rank(r)
+		if labeledRank, _ := labeled.rank(r); !labeledRank.above(configuredRank) {
+			return configured, true
+		}
+	}
+	return labeled, true
+}
+
+// endpoints returns where the name:port target is reachable: the containers
+// themselves on a shared network, else their ports published on the gateway
+// ip.
+func (d *Docker) endpoints(r *routing, target string) ([]string, bool) {
+	name, port, _ := net.SplitHostPort(target)
+	ips, ok := r.addresses[target]
+	if !ok {
+		ips, ok = r.addresses[name]
+	}
+	endpoints := []string{}
+	if ok {
+		for _, ip := range ips {
+			endpoints = append(endpoints, net.JoinHostPort(ip, port))
+		}
+		return endpoints, true
+	}
+	if dstPorts, ok := r.portMappings[target]; ok && d.gatewayIp != "" {
+		for _, dstPort := range dstPorts {
+			endpoints = append(endpoints, fmt.Sprintf("%s:%d", d.gatewayIp, dstPort))
+		}
+		return endpoints, true
+	}
+	return nil, false
+}
+
+func (d *Docker) resolve(r *http.Request) (Destination, error) {
+	srcHost := strings.Split(r.Host, ":")[0]
 	dstHost := d.gatewayIp
-	fmt.Printf("Key: [%s]\n", srcHost)
+	routing := d.currentRouting()
 
-	if dstHostPort, ok := d.proxyMappings[srcHost]; ok {
-		if dstPort, ok := d.portMappings[dstHostPort]; ok {
-			return fmt.Sprintf("%s:%d", dstHost, dstPort), nil
+	if route, ok := d.matchRoute(routing, srcHost, r); ok {
+		if destination, ok := d.destination(routing, route, route.Target(), r); ok {
+			return destination, nil
 		}
-		return "", errors.New(fmt.Sprintf("No destination found for host '%s' (%s)", srcHost, dstHostPort))
+		return Destination{}, errors.New(fmt.Sprintf("No destination found for host '%s' (%s)", srcHost, route.Target()))
 	}
 
-	srcHostLevels := regexp.MustCompile(d.stackSearchString).FindStringSubmatch(srcHost)
-	if len(srcHostLevels) > 1 {
-		srcHost = srcHostLevels[1]
-		if dstHostPort, ok := d.proxyMappings[srcHost]; ok {
-			if dstPort, ok := d.portMappings[dstHostPort]; ok {
-				return fmt.Sprintf("%s:%d", dstHost, dstPort), nil
+	if stack, _, found := d.findStack(srcHost); found {
+		srcHost = stack
+		if route, ok := d.matchRoute(routing, srcHost, r); ok {
+			if destination, ok := d.destination(routing, route, route.Target(), r); ok {
+				return destination, nil
 			}
-			return "", errors.New(fmt.Sprintf("No destination found for stack name '%s' (%s)", srcHost, dstHost))
+			return Destination{}, errors.New(fmt.Sprintf("No destination found for stack name '%s' (%s)", srcHost, dstHost))
 		}
 	}
 
 	if d.proxyOnlyMappedHosts {
-		return "", errors.New(fmt.Sprintf("Only configured gateways allowed ('%s' not found)", srcHost))
+		return Destination{}, errors.New(fmt.Sprintf("Only configured gateways allowed ('%s' not found)", srcHost))
 	}
 
-	dstHostPort = fmt.Sprintf("%s:%d", srcHost, 80)
-	if dstPort, ok := d.portMappings[dstHostPort]; ok {
-		return fmt.Sprintf("%s:%d", dstHost, dstPort), nil
+	dstHostPort := fmt.Sprintf("%s:%d", srcHost, 80)
+	if destination, ok := d.destination(routing, nil, dstHostPort, r); ok {
+		return destination, nil
 	}
-	return "", errors.New(fmt.Sprintf("No destination, exhausted all methods '%s' (%s)", srcHost, dstHostPort))
+	return Destination{}, errors.New(fmt.Sprintf("No destination, exhausted all methods '%s' (%s)", srcHost, dstHostPort))
 }
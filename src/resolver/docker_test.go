@@ -1,15 +1,28 @@
 package resolver
 
-import "testing"
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+)
 
 func TestGetDestinationHostPort(t *testing.T) {
 	d := &Docker{
 		gatewayIp:            "gateway",
 		proxyOnlyMappedHosts: false,
-		stackSearchString:    "([^\\.]+)\\.(local|dev|build|test|stage|preprod|prod)\\.",
+		stackSearch:          regexp.MustCompile("([^\\.]+)\\.(local|dev|build|test|stage|preprod|prod)\\."),
 	}
-	d.proxyMappings, _ = d.parseProxyMappings("src:bob:80 abc:3000 web.site.com:web") //map[string]string{"bob": "5"} //  "src:dst:80 host:80 web.site.com:web",
-	d.portMappings = map[string]uint16{"bob:80": 5, "bob_stack_1:80": 5, "abc_stack:3000": 18, "abc_stack_1:3000": 18, "bob_stack:80": 5, "abc:3000": 18, "web:80": 42}
+	d.SetRoutes(ParseProxyMappings("src:bob:80 abc:3000 web.site.com:web")) //map[string]string{"bob": "5"} //  "src:dst:80 host:80 web.site.com:web",
+	d.publish(&routing{portMappings: map[string][]uint16{"bob:80": {5}, "bob_stack_1:80": {5}, "abc_stack:3000": {18}, "abc_stack_1:3000": {18}, "bob_stack:80": {5}, "abc:3000": {18}, "web:80": {42}}})
 
 	dstHostPort, err := d.GetDestinationHostPort("abc.bob.local.test.tld")
 	if dstHostPort != "gateway:5" {
@@ -31,3 +44,397 @@ func TestGetDestinationHostPort(t *testing.T) {
 		t.Errorf("Source host should equal destination host and have default port, got: %s. (%#v)", dstHostPort, err)
 	}
 }
+
+func TestDockerRoutes(t *testing.T) {
+	d := &Docker{
+		gatewayIp:   "gateway",
+		stackSearch: regexp.MustCompile("([^\\.]+)\\.(local|dev|build|test|stage|preprod|prod)\\."),
+	}
+	d.SetRoutes(ParseProxyMappings("src:bob:80 abc:3000 web.site.com:web"))
+	d.publish(&routing{portMappings: map[string][]uint16{"bob:80": {5}, "abc:3000": {18}, "web:80": {42}}})
+
+	for host, routed := range map[string]bool{
+		"web.site.com":           true,
+		"web.site.com:443":       true,
+		"api.abc.local.test.tld": true,
+		"api.bob.local.test.tld": true,
+		"api.joe.local.test.tld": false,
+		"unknown.example.com":    false,
+		// the stack search only allows one label in front of the stack
+		"a.api.abc.local.test.tld": false,
+	} {
+		if d.Routable(host) != routed {
+			t.Errorf("Expected %s to be routed: %v", host, routed)
+		}
+	}
+	d.proxyOnlyMappedHosts = true
+	if d.Routable("api.bob.local.test.tld") || !d.Routable("api.abc.local.test.tld") {
+		t.Errorf("Expected only mapped hosts to be routed")
+	}
+}
+
+func testContainer(name string, privatePort, publicPort uint16) types.Container {
+	return types.Container{
+		Names: []string{"/" + name},
+		Ports: []types.Port{{PrivatePort: privatePort, PublicPort: publicPort, Type: "tcp"}},
+	}
+}
+
+func testService(stack string, targetPort, publishedPort uint32) swarm.Service {
+	service := swarm.Service{}
+	service.Spec.Labels = map[string]string{"com.docker.stack.namespace": stack}
+	service.Endpoint.Ports = []swarm.PortConfig{{Protocol: "tcp", TargetPort: targetPort, PublishedPort: publishedPort}}
+	return service
+}
+
+// Docker events refresh the routing on their own goroutine while requests
+// resolve destinations on theirs; run with -race.
+func TestConcurrentRefreshAndLookup(t *testing.T) {
+	d := &Docker{
+		gatewayIp:   "gateway",
+		stackSearch: regexp.MustCompile("([^\\.]+)\\.(local|dev|build|test|stage|preprod|prod)\\."),
+	}
+	d.SetRoutes(ParseProxyMappings("web api:3000"))
+	d.publish(d.newRouting([]types.Container{testContainer("web_1", 80, 8000)}, nil))
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				dstHostPort, err := d.GetDestinationHostPort("web.local.example")
+				if err != nil || !strings.HasPrefix(dstHostPort, "gateway:80") {
+					t.Errorf("Expected web to resolve to a published port, got: %s. (%v)", dstHostPort, err)
+					return
+				}
+				d.GetDestinationHostPort("api.local.example")
+			}
+		}()
+	}
+
+	for i := 0; i < 500; i++ {
+		containers := []types.Container{testContainer("web_1", 80, uint16(8000+i%10))}
+		services := []swarm.Service{testService("api", 3000, uint32(9000+i%10))}
+		d.publish(d.newRouting(containers, services))
+		if i%50 == 0 {
+			d.SetRoutes(ParseProxyMappings("web api:3000"))
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestFetchContainerPorts(t *testing.T) {
+	f := newFakeDocker()
+	labeled := testContainer("api_1", 3000, 9000)
+	labeled.Labels = map[string]string{"gateway.stack.name": "api"}
+	udp := testContainer("dns_1", 53, 5300)
+	udp.Ports[0].Type = "udp"
+	f.setContainers(
+		testContainer("web_stack_1", 80, 8000),
+		labeled,
+		udp,
+		testContainer("internal_1", 80, 0),
+	)
+	d := &Docker{client: f}
+
+	ports := containerPorts(d.fetchContainers())
+	for _, key := range []string{"web_stack_1:80", "web_stack:80", "web:80"} {
+		if !reflect.DeepEqual(ports[key], []uint16{8000}) {
+			t.Errorf("Container names should be matched with and without their _ suffixes, %s got: %v", key, ports[key])
+		}
+	}
+	if !reflect.DeepEqual(ports["api:3000"], []uint16{9000}) {
+		t.Errorf("Stack name label should name the container, got: %v", ports)
+	}
+	for _, key := range []string{"api_1:3000", "dns:53", "internal:80"} {
+		if _, found := ports[key]; found {
+			t.Errorf("Unexpected port mapping %s, got: %v", key, ports)
+		}
+	}
+}
+
+func TestFetchServicePorts(t *testing.T) {
+	deployed := func(stack string, port uint32, created time.Time, healthy bool) swarm.Service {
+		service := testService(stack, 80, port)
+		service.CreatedAt = created
+		service.Spec.Labels["gateway.deployment"] = "shop"
+		if healthy {
+			service.Spec.Labels["gateway.healthy"] = "true"
+		}
+		return service
+	}
+	created := time.Now().Add(-time.Hour)
+
+	f := newFakeDocker()
+	f.swarmMode = true
+	d := &Docker{client: f, swarm: Swarm{deploymentLabel: "gateway.deployment", healthLabel: "gateway.healthy"}}
+
+	for _, test := range []struct {
+		description string
+		services    []swarm.Service
+		port        uint16
+	}{
+		{"the healthy stack is active", []swarm.Service{
+			deployed("shop_v1", 8001, created, true),
+			deployed("shop_v2", 8002, created.Add(time.Minute), false),
+		}, 8001},
+		{"the newest healthy stack is active", []swarm.Service{
+			deployed("shop_v1", 8001, created, true),
+			deployed("shop_v2", 8002, created.Add(time.Minute), true),
+		}, 8002},
+		{"the newest stack is used when none are healthy", []swarm.Service{
+			deployed("shop_v1", 8001, created.Add(time.Minute), false),
+			deployed("shop_v2", 8002, created, false),
+		}, 8001},
+	} {
+		f.setServices(test.services...)
+		d.fetchPorts()
+		if ports := d.currentRouting().portMappings["shop:80"]; !reflect.DeepEqual(ports, []uint16{test.port}) {
+			t.Errorf("Expected %s, routing to %d, got: %v", test.description, test.port, ports)
+		}
+	}
+
+	f.swarmMode = false
+	d.fetchPorts()
+	if _, found := d.currentRouting().portMappings["shop:80"]; found {
+		t.Errorf("Services should be ignored outside of swarm mode")
+	}
+}
+
+func TestEventsRefreshRouting(t *testing.T) {
+	f := newFakeDocker()
+	f.setContainers(testContainer("web_1", 80, 8000))
+	d := &Docker{
+		client:      f,
+		gatewayIp:   "gateway",
+		stackSearch: regexp.MustCompile("([^\\.]+)\\.(local|dev|build|test|stage|preprod|prod)\\."),
+	}
+	d.SetRoutes(ParseProxyMappings("web api:3000"))
+	d.fetchPorts()
+
+	done := make(chan struct{})
+	go func() {
+		d.listenEvents()
+		close(done)
+	}()
+	defer func() {
+		f.close()
+		<-done
+	}()
+
+	if _, err := d.GetDestinationHostPort("api.local.example"); err == nil {
+		t.Fatalf("api should not resolve before it is started")
+	}
+
+	calls := f.containerListCalls()
+	f.emit(events.ContainerEventType, "health_status: healthy")
+	f.emit(events.ContainerEventType, "exec_start: sh")
+	f.setContainers(testContainer("web_1", 80, 8000), testContainer("api_1", 3000, 9000))
+	f.emit(events.ContainerEventType, "start")
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		dstHostPort, err := d.GetDestinationHostPort("api.local.example")
+		if err == nil {
+			if dstHostPort != "gateway:9000" {
+				t.Errorf("Expected api to resolve to its published port, got: %s", dstHostPort)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Routing was not refreshed after a container event: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := f.containerListCalls() - calls; n != 1 {
+		t.Errorf("Health and exec events should not refresh the routing, got %d refreshes", n)
+	}
+}
+
+func TestDockerWantsClientCert(t *testing.T) {
+	d := &Docker{
+		gatewayIp:   "gateway",
+		stackSearch: regexp.MustCompile("([^\\.]+)\\.(local|dev|build|test|stage|preprod|prod)\\."),
+	}
+	d.SetRoutes([]Route{{Name: "console", Host: "console", Destination: "console", Port: 80, ClientCA: "/clients.pem"}, {Name: "shop", Host: "shop", Destination: "shop", Port: 80}})
+
+	for host, wanted := range map[string]bool{
+		"console":                 true,
+		"console.example.test":    true,
+		"api.console.dev.example": true,
+		"shop.example.test":       false,
+		"api.shop.dev.example":    false,
+	} {
+		if d.WantsClientCert(host) != wanted {
+			t.Errorf("Expected a client certificate to be wanted for %s: %v", host, wanted)
+		}
+	}
+}
+
+func TestLabelRoutes(t *testing.T) {
+	api := testContainer("shop_api_1", 3000, 9000)
+	api.Labels = map[string]string{"gateway.host": "shop.example.test", "gateway.path-prefix": "/v1"}
+	web := testContainer("shop_web_1", 8080, 9001)
+	web.Ports = append(web.Ports, types.Port{PrivatePort: 8443, PublicPort: 9002, Type: "tcp"})
+	web.Labels = map[string]string{"gateway.host": "shop.example.test, www.example.test", "gateway.port": "8080", "gateway.https": "false"}
+	broken := testContainer("broken_1", 80, 9003)
+	broken.Labels = map[string]string{"gateway.host": "broken.example.test", "gateway.port": "http"}
+	balanced := testContainer("balanced_1", 80, 9005)
+	balanced.Labels = map[string]string{"gateway.host": "balanced.example.test", "gateway.load-balancing": "fastest"}
+	checked := testContainer("checked_1", 80, 9006)
+	checked.Labels = map[string]string{"gateway.host": "checked.example.test", "gateway.health-check.type": "ping"}
+	admin := testService("admin_v1", 80, 9004)
+	admin.Spec.Labels["gateway.host"] = "admin.example.test"
+
+	d := &Docker{gatewayIp: "gateway", proxyOnlyMappedHosts: true}
+	d.publish(d.newRouting([]types.Container{api, web, broken, balanced, checked}, []swarm.Service{admin}))
+
+	for _, test := range []struct {
+		host, path, hostPort string
+		http                 bool
+	}{
+		{"shop.example.test", "/v1/orders", "gateway:9000", false},
+		{"shop.example.test", "/", "gateway:9001", true},
+		{"www.example.test", "/v1", "gateway:9001", true},
+		{"admin.example.test", "/", "gateway:9004", false},
+	} {
+		destination, err := d.Resolve(HostRequest(test.host, test.path))
+		if err != nil || destination.HostPort != test.hostPort {
+			t.Errorf("Expected %s%s to route to %s, got: %s. (%v)", test.host, test.path, test.hostPort, destination.HostPort, err)
+			continue
+		}
+		if destination.Route.HTTP != test.http {
+			t.Errorf("Expected %s%s to be served over http: %v", test.host, test.path, test.http)
+		}
+	}
+	for _, host := range []string{"broken.example.test", "balanced.example.test", "checked.example.test"} {
+		if _, err := d.Resolve(HostRequest(host, "/")); err == nil {
+			t.Errorf("Containers with invalid labels should not be routed, %s was", host)
+		}
+	}
+	if !d.Routable("www.example.test") || d.Routable("broken.example.test") {
+		t.Errorf("Expected the labeled hosts to be routed")
+	}
+}
+
+func attach(container types.Container, networkName, networkID, ip string) types.Container {
+	if container.NetworkSettings == nil {
+		container.NetworkSettings = &types.SummaryNetworkSettings{Networks: map[string]*network.EndpointSettings{}}
+	}
+	container.NetworkSettings.Networks[networkName] = &network.EndpointSettings{NetworkID: networkID, IPAddress: ip}
+	return container
+}
+
+func TestNetworkRouting(t *testing.T) {
+	gateway := attach(testContainer("gateway_1", 80, 80), "front", "front-id", "172.20.0.2")
+	gateway.ID = "0123456789abcdef"
+	// unpublished ports are routed over the network
+	web := attach(testContainer("web_1", 8080, 0), "front", "front-id", "172.20.0.3")
+	// containers on other networks fall back to their published port
+	db := attach(testContainer("db_1", 5432, 15432), "back", "back-id", "172.30.0.3")
+	api := testService("api", 3000, 0)
+	api.Endpoint.VirtualIPs = []swarm.EndpointVirtualIP{{NetworkID: "front-id", Addr: "10.0.1.5/24"}}
+
+	d := &Docker{gatewayIp: "gateway", networkRouting: true, hostname: "0123456789ab"}
+	d.SetRoutes(ParseProxyMappings("web:8080 db:5432 api:3000 other:api:4000"))
+	d.publish(d.newRouting([]types.Container{gateway, web, db}, []swarm.Service{api}))
+
+	for host, hostPort := range map[string]string{
+		"web":   "172.20.0.3:8080",
+		"db":    "gateway:15432",
+		"api":   "10.0.1.5:3000",
+		"other": "10.0.1.5:4000",
+	} {
+		dstHostPort, err := d.GetDestinationHostPort(host)
+		if dstHostPort != hostPort {
+			t.Errorf("Expected %s to route to %s, got: %s. (%v)", host, hostPort, dstHostPort, err)
+		}
+	}
+
+	d.networks = "back"
+	d.publish(d.newRouting([]types.Container{gateway, web, db}, nil))
+	if dstHostPort, err := d.GetDestinationHostPort("db"); dstHostPort != "172.30.0.3:5432" {
+		t.Errorf("docker-networks should override the gateway networks, got: %s. (%v)", dstHostPort, err)
+	}
+	if _, err := d.GetDestinationHostPort("web"); err == nil {
+		t.Errorf("Unpublished containers off the routed networks should not be routed")
+	}
+}
+
+func TestScaledServiceEndpoints(t *testing.T) {
+	d := &Docker{gatewayIp: "gateway"}
+	d.SetRoutes(ParseProxyMappings("web"))
+	d.publish(d.newRouting([]types.Container{
+		testContainer("web_2", 80, 8002),
+		testContainer("web_1", 80, 8001),
+		testContainer("web_3", 80, 8001),
+	}, nil))
+
+	destination, err := d.Resolve(HostRequest("web", "/"))
+	if err != nil || !reflect.DeepEqual(destination.Endpoints, []string{"gateway:8001", "gateway:8002"}) {
+		t.Errorf("Replicas should each be an endpoint, sorted and listed once, got: %v. (%v)", destination.Endpoints, err)
+	}
+	if destination.HostPort != "gateway:8001" {
+		t.Errorf("HostPort should be the first endpoint, got: %s", destination.HostPort)
+	}
+	destination, err = d.Resolve(HostRequest("web_2", "/"))
+	if err != nil || !reflect.DeepEqual(destination.Endpoints, []string{"gateway:8002"}) {
+		t.Errorf("Full container names should route to that container only, got: %v. (%v)", destination.Endpoints, err)
+	}
+}
+
+func TestLabelConditions(t *testing.T) {
+	preview := testContainer("shop_feature_1", 80, 9100)
+	preview.Labels = map[string]string{"gateway.host": "shop.example.test", "gateway.cookies": "stack=feature"}
+	broken := testContainer("broken_1", 80, 9101)
+	broken.Labels = map[string]string{"gateway.host": "shop.example.test", "gateway.headers": "X-Canary"}
+
+	d := &Docker{gatewayIp: "gateway", proxyOnlyMappedHosts: true}
+	d.SetRoutes([]Route{{Host: "shop.example.test", Destination: "shop", Port: 80}})
+	d.publish(d.newRouting([]types.Container{testContainer("shop_1", 80, 9000), preview, broken}, nil))
+
+	r := HostRequest("shop.example.test", "/")
+	if destination, err := d.Resolve(r); err != nil || destination.HostPort != "gateway:9000" {
+		t.Errorf("Expected the configured route to serve everyone else, got: %s. (%v)", destination.HostPort, err)
+	}
+	r.AddCookie(&http.Cookie{Name: "stack", Value: "feature"})
+	if destination, err := d.Resolve(r); err != nil || destination.HostPort != "gateway:9100" {
+		t.Errorf("Expected the labeled cookie route to win over the configured one, got: %s. (%v)", destination.HostPort, err)
+	}
+}
+
+func TestLabeledScaledService(t *testing.T) {
+	labels := map[string]string{"gateway.host": "api.example.test", "gateway.port": "3000"}
+	replicas := []types.Container{}
+	for n, name := range []string{"shop_api_1", "shop_api_2", "shop-worker-1", "shop-worker-2"} {
+		replica := testContainer(name, 3000, uint16(9001+n))
+		replica.Labels = labels
+		if strings.Contains(name, "worker") {
+			replica.Labels = map[string]string{"gateway.host": "worker.example.test"}
+		}
+		replicas = append(replicas, replica)
+	}
+	d := &Docker{gatewayIp: "gw", proxyOnlyMappedHosts: true}
+	d.publish(d.newRouting(replicas, nil))
+
+	for host, endpoints := range map[string][]string{
+		"api.example.test":    {"gw:9001", "gw:9002"},
+		"worker.example.test": {"gw:9003", "gw:9004"},
+	} {
+		destination, err := d.Resolve(HostRequest(host, "/"))
+		if err != nil || !reflect.DeepEqual(destination.Endpoints, endpoints) {
+			t.Errorf("Expected the replicas behind %s to be endpoints of one route, got: %v. (%v)", host, destination.Endpoints, err)
+		}
+	}
+	if routes := d.Destinations(); len(routes) != 2 {
+		t.Errorf("Expected one route per labeled service, got %v", routes)
+	}
+}
@@ -0,0 +1,84 @@
+package resolver
+
+import (
+	"io"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/swarm"
+	"golang.org/x/net/context"
+)
+
+// fakeDocker is an in-memory DockerAPI. Tests change its containers and
+// services and emit events, just like a running engine would.
+type fakeDocker struct {
+	mu         sync.Mutex
+	containers []types.Container
+	services   []swarm.Service
+	swarmMode  bool
+	listCalls  int
+
+	messages chan events.Message
+	errs     chan error
+}
+
+func newFakeDocker() *fakeDocker {
+	return &fakeDocker{
+		messages: make(chan events.Message),
+		errs:     make(chan error, 1),
+	}
+}
+
+func (f *fakeDocker) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.listCalls++
+	return append([]types.Container{}, f.containers...), nil
+}
+
+func (f *fakeDocker) ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]swarm.Service{}, f.services...), nil
+}
+
+func (f *fakeDocker) Info(ctx context.Context) (types.Info, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	info := types.Info{}
+	info.Swarm.ControlAvailable = f.swarmMode
+	return info, nil
+}
+
+func (f *fakeDocker) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	return f.messages, f.errs
+}
+
+func (f *fakeDocker) containerListCalls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.listCalls
+}
+
+func (f *fakeDocker) setContainers(containers ...types.Container) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.containers = containers
+}
+
+func (f *fakeDocker) setServices(services ...swarm.Service) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.services = services
+}
+
+// emit blocks until the resolver has picked up the event
+func (f *fakeDocker) emit(eventType, action string) {
+	f.messages <- events.Message{Type: eventType, Action: action}
+}
+
+// close ends the event stream, like the engine closing the connection
+func (f *fakeDocker) close() {
+	f.errs <- io.EOF
+}
@@ -0,0 +1,223 @@
+package resolver
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// Labels containers and swarm services can carry to register routes on the
+// gateway themselves, instead of being listed in the gateway configuration.
+const (
+	// labelHost is a comma separated list of hosts routed to the container
+	labelHost = "gateway.host"
+	// labelPort is the container port to route to. It defaults to the only
+	// published port, or 80 when there are several.
+	labelPort = "gateway.port"
+	// labelPathPrefix limits the routes to paths starting with it, and
+	// labelPathRegex to paths whose start matches it
+	labelPathPrefix = "gateway.path-prefix"
+	labelPathRegex  = "gateway.path-regex"
+	// labelStripPrefix set to true removes the matched path before
+	// forwarding, labelRewrite replaces it
+	labelStripPrefix = "gateway.strip-prefix"
+	labelRewrite     = "gateway.rewrite"
+	// labelHTTPS set to false keeps serving the hosts over plain http when
+	// https is enabled
+	labelHTTPS = "gateway.https"
+	// labelName names the routes, it defaults to the container or deployment
+	labelName = "gateway.name"
+	// labelMethods is a comma separated list of methods the routes are
+	// limited to, labelHeaders, labelCookies and labelQuery comma separated
+	// name=value pairs requests must carry (a value of * matches any)
+	labelMethods = "gateway.methods"
+	labelHeaders = "gateway.headers"
+	labelCookies = "gateway.cookies"
+	labelQuery   = "gateway.query"
+	// labelPriority ranks the routes above others of the same host
+	labelPriority = "gateway.priority"
+	// labelLoadBalancing sets the load balancing policy across replicas
+	labelLoadBalancing = "gateway.load-balancing"
+	// labelHealthCheck prefixes the health check settings: .type, .path,
+	// .interval and .timeout
+	labelHealthCheck = "gateway.health-check"
+)
+
+// containerRoutes returns the routes labeled on the containers. The replicas
+// of a scaled service share their routes, to the service name, which the
+// endpoints of every replica are found by.
+func containerRoutes(containers []types.Container) []Route {
+	routes := []Route{}
+	services := map[string]bool{}
+	for _, container := range containers {
+		if container.Labels[labelHost] == "" || len(container.Names) == 0 {
+			continue
+		}
+		name := serviceName(container)
+		if services[name] {
+			continue
+		}
+		services[name] = true
+		ports := []uint16{}
+		for _, port := range container.Ports {
+			if port.Type == "tcp" && port.PublicPort > 0 {
+				ports = append(ports, port.PrivatePort)
+			}
+		}
+		routes = append(routes, labelRoutes(container.Labels, name, ports)...)
+	}
+	return routes
+}
+
+// labelPairs parses comma separated name=value pairs
+func labelPairs(value string) (map[string]string, error) {
+	pairs := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		nv := strings.SplitN(pair, "=", 2)
+		if len(nv) != 2 || strings.TrimSpace(nv[0]) == "" {
+			return nil, errors.New(fmt.Sprintf("expected name=value, got '%s'", pair))
+		}
+		pairs[strings.TrimSpace(nv[0])] = strings.TrimSpace(nv[1])
+	}
+	return pairs, nil
+}
+
+// labelRoutes turns the gateway labels of a container or service into
+// routes to destination, which exposes the given ports.
+func labelRoutes(labels map[string]string, destination string, ports []uint16) []Route {
+	port := uint16(80)
+	if len(ports) == 1 {
+		port = ports[0]
+	}
+	if value, found := labels[labelPort]; found {
+		labeled, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			log.Printf("Ignoring routes to '%s', invalid %s label '%s'", destination, labelPort, value)
+			return nil
+		}
+		port = uint16(labeled)
+	}
+
+	http := false
+	if value, found := labels[labelHTTPS]; found {
+		https, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Printf("Ignoring routes to '%s', invalid %s label '%s'", destination, labelHTTPS, value)
+			return nil
+		}
+		http = !https
+	}
+
+	var check *HealthCheck
+	for _, setting := range []string{"type", "path", "interval", "timeout"} {
+		value, found := labels[labelHealthCheck+"."+setting]
+		if !found {
+			continue
+		}
+		if check == nil {
+			check = &HealthCheck{}
+		}
+		var err error
+		switch setting {
+		case "type":
+			check.Type = value
+		case "path":
+			check.Path = value
+		case "interval":
+			check.Interval, err = time.ParseDuration(value)
+		case "timeout":
+			check.Timeout, err = time.ParseDuration(value)
+		}
+		if err != nil {
+			log.Printf("Ignoring routes to '%s', invalid %s.%s label '%s'", destination, labelHealthCheck, setting, value)
+			return nil
+		}
+	}
+
+	priority := 0
+	if value, found := labels[labelPriority]; found {
+		var err error
+		if priority, err = strconv.Atoi(value); err != nil {
+			log.Printf("Ignoring routes to '%s', invalid %s label '%s'", destination, labelPriority, value)
+			return nil
+		}
+	}
+	conditions := map[string]map[string]string{}
+	for _, label := range []string{labelHeaders, labelCookies, labelQuery} {
+		value, found := labels[label]
+		if !found {
+			continue
+		}
+		pairs, err := labelPairs(value)
+		if err != nil {
+			log.Printf("Ignoring routes to '%s', invalid %s label '%s': %v", destination, label, value, err)
+			return nil
+		}
+		conditions[label] = pairs
+	}
+	var methods []string
+	for _, method := range strings.Split(labels[labelMethods], ",") {
+		if method = strings.TrimSpace(method); method != "" {
+			methods = append(methods, strings.ToUpper(method))
+		}
+	}
+
+	strip := false
+	if value, found := labels[labelStripPrefix]; found {
+		var err error
+		if strip, err = strconv.ParseBool(value); err != nil {
+			log.Printf("Ignoring routes to '%s', invalid %s label '%s'", destination, labelStripPrefix, value)
+			return nil
+		}
+	}
+
+	prefix := labels[labelPathPrefix]
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	name := labels[labelName]
+	if name == "" {
+		name = destination
+	}
+
+	routes := []Route{}
+	for _, host := range strings.Split(labels[labelHost], ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		routes = append(routes, Route{
+			Name:          name,
+			Host:          host,
+			Destination:   destination,
+			Port:          port,
+			PathPrefix:    prefix,
+			PathRegex:     labels[labelPathRegex],
+			StripPrefix:   strip,
+			Rewrite:       labels[labelRewrite],
+			Methods:       methods,
+			Headers:       conditions[labelHeaders],
+			Cookies:       conditions[labelCookies],
+			Query:         conditions[labelQuery],
+			Priority:      priority,
+			HTTP:          http,
+			LoadBalancing: labels[labelLoadBalancing],
+			HealthCheck:   check,
+		})
+	}
+	for _, route := range routes {
+		if err := route.Validate(); err != nil {
+			log.Printf("Ignoring routes to '%s': %v", destination, err)
+			return nil
+		}
+	}
+	return routes
+}
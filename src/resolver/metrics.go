@@ -0,0 +1,17 @@
+package resolver
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	dockerEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_docker_events_total",
+		Help: "Docker events received, by type and whether they refreshed the routing.",
+	}, []string{"type", "refreshed"})
+	dockerRefreshes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_docker_refreshes_total",
+		Help: "Routing refreshes from the containers and services running.",
+	})
+)
@@ -0,0 +1,475 @@
+package resolver
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Route maps a source host onto a destination host and port. Routes come
+// from the configuration file, the proxy-mappings flag or Docker labels.
+type Route struct {
+	Name        string `yaml:"name" json:"name,omitempty"`
+	Host        string `yaml:"host" json:"host,omitempty"`
+	Destination string `yaml:"destination" json:"destination,omitempty"`
+	Port        uint16 `yaml:"port" json:"port,omitempty"`
+
+	// PathPrefix limits the route to request paths starting with it, and
+	// PathRegex to paths whose start matches it. When several routes of a
+	// host match, the longest match wins.
+	PathPrefix string `yaml:"path-prefix" json:"path-prefix,omitempty"`
+	PathRegex  string `yaml:"path-regex" json:"path-regex,omitempty"`
+	// StripPrefix removes the matched part of the path before forwarding,
+	// Rewrite replaces it (a regex replacement may refer to groups as $1)
+	StripPrefix bool   `yaml:"strip-prefix" json:"strip-prefix,omitempty"`
+	Rewrite     string `yaml:"rewrite" json:"rewrite,omitempty"`
+	// Methods, Headers, Cookies and Query limit the route to requests using
+	// one of the methods, and carrying each header, cookie and query
+	// parameter with the given value. A value of * only requires presence.
+	Methods []string          `yaml:"methods" json:"methods,omitempty"`
+	Headers map[string]string `yaml:"headers" json:"headers,omitempty"`
+	Cookies map[string]string `yaml:"cookies" json:"cookies,omitempty"`
+	Query   map[string]string `yaml:"query" json:"query,omitempty"`
+	// Priority ranks the routes of a host matching a request, highest first.
+	// Among routes of the same priority the longest path match wins, then
+	// the route with the most conditions.
+	Priority int `yaml:"priority" json:"priority,omitempty"`
+	// HTTP serves the host over plain http, even when https is enabled
+	HTTP bool `yaml:"http" json:"http,omitempty"`
+	// LoadBalancing overrides the load balancing policy for the route
+	LoadBalancing string `yaml:"load-balancing" json:"load-balancing,omitempty"`
+	// HealthCheck probes the endpoints of the route, and takes those that
+	// fail out of the balancing
+	HealthCheck *HealthCheck `yaml:"health-check" json:"health-check,omitempty"`
+	// ClientCA is a PEM bundle of the CAs a client certificate must be
+	// signed by, requests without one are refused. ClientSubjects further
+	// limits the clients to these subject common names or alternative names.
+	ClientCA       string   `yaml:"client-ca" json:"client-ca,omitempty"`
+	ClientSubjects []string `yaml:"client-subjects" json:"client-subjects,omitempty"`
+}
+
+// HealthCheck describes how the endpoints of a route are probed. Zero values
+// are left for the health checker to default.
+type HealthCheck struct {
+	// Type is http, which requests Path and expects a 2xx or 3xx status, or
+	// tcp, which only connects
+	Type     string        `yaml:"type" json:"type,omitempty"`
+	Path     string        `yaml:"path" json:"path,omitempty"`
+	Interval time.Duration `yaml:"interval" json:"interval,omitempty"`
+	Timeout  time.Duration `yaml:"timeout" json:"timeout,omitempty"`
+	// HealthyThreshold is the number of checks in a row to pass before an
+	// endpoint is up again, UnhealthyThreshold the number to fail before it
+	// is down
+	HealthyThreshold   int `yaml:"healthy-threshold" json:"healthy-threshold,omitempty"`
+	UnhealthyThreshold int `yaml:"unhealthy-threshold" json:"unhealthy-threshold,omitempty"`
+}
+
+// Target returns the destination as dsthost:dstport
+func (r *Route) Target() string {
+	return fmt.Sprintf("%s:%d", r.Destination, r.Port)
+}
+
+// String describes the route as host[/prefix][~regex] [conditions] ->
+// dsthost:dstport
+func (r *Route) String() string {
+	return fmt.Sprintf("%s%s -> %s", r.Host, r.matchKey(), r.Target())
+}
+
+// conditions describes what the route requires of requests besides the path
+func (r *Route) conditions() []string {
+	conditions := []string{}
+	if len(r.Methods) > 0 {
+		conditions = append(conditions, "method="+strings.ToUpper(strings.Join(r.Methods, ",")))
+	}
+	for kind, values := range map[string]map[string]string{"header": r.Headers, "cookie": r.Cookies, "query": r.Query} {
+		for name, value := range values {
+			if kind == "header" {
+				name = http.CanonicalHeaderKey(name)
+			}
+			conditions = append(conditions, fmt.Sprintf("%s:%s=%s", kind, name, value))
+		}
+	}
+	sort.Strings(conditions)
+	return conditions
+}
+
+// matchKey identifies the requests a route matches among the routes of its
+// host
+func (r *Route) matchKey() string {
+	if conditions := r.conditions(); len(conditions) > 0 {
+		return r.pathKey() + " [" + strings.Join(conditions, " ") + "]"
+	}
+	return r.pathKey()
+}
+
+// pathKey identifies the paths a route matches among the routes of its host
+func (r *Route) pathKey() string {
+	if r.PathRegex != "" {
+		return r.PathPrefix + "~" + r.PathRegex
+	}
+	return r.PathPrefix
+}
+
+// Validate checks the settings that can not be checked when parsing.
+func (r *Route) Validate() error {
+	if r.LoadBalancing != "" && !oneOf(r.LoadBalancing, LoadBalancingPolicies) {
+		return errors.New(fmt.Sprintf("Route '%s' has an unknown load balancing policy '%s' (%s)", r.Host, r.LoadBalancing, strings.Join(LoadBalancingPolicies, ", ")))
+	}
+	if r.HealthCheck != nil && r.HealthCheck.Type != "" && !oneOf(r.HealthCheck.Type, HealthCheckTypes) {
+		return errors.New(fmt.Sprintf("Route '%s' has an unknown health check type '%s' (%s)", r.Host, r.HealthCheck.Type, strings.Join(HealthCheckTypes, ", ")))
+	}
+	if r.PathRegex == "" {
+		return nil
+	}
+	if r.PathPrefix != "" {
+		return errors.New(fmt.Sprintf("Route '%s' sets both a path prefix and a path regex", r.Host))
+	}
+	if _, err := pathRegexp(r.PathRegex); err != nil {
+		return errors.New(fmt.Sprintf("Route '%s' has an invalid path regex: %v", r.Host, err))
+	}
+	return nil
+}
+
+// LoadBalancingPolicies are the policies routes may set, HealthCheckTypes the
+// ways their endpoints may be probed
+var (
+	LoadBalancingPolicies = []string{"round-robin", "least-connections", "random", "hash"}
+	HealthCheckTypes      = []string{"http", "tcp"}
+)
+
+func oneOf(value string, values []string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// pathRegexps caches the compiled path regexes, which are anchored to the
+// start of the path
+var pathRegexps sync.Map
+
+func pathRegexp(expr string) (*regexp.Regexp, error) {
+	if re, ok := pathRegexps.Load(expr); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile("^(?:" + expr + ")")
+	if err != nil {
+		return nil, err
+	}
+	pathRegexps.Store(expr, re)
+	return re, nil
+}
+
+// matchPath returns the length of the start of the path the route matches,
+// or -1 when it does not match.
+func (r *Route) matchPath(path string) int {
+	if r.PathRegex != "" {
+		re, err := pathRegexp(r.PathRegex)
+		if err != nil {
+			return -1
+		}
+		if loc := re.FindStringIndex(path); loc != nil {
+			return loc[1]
+		}
+		return -1
+	}
+	// the prefix ends on a segment boundary, /api does not match /apiary
+	prefix := r.PathPrefix
+	if strings.HasPrefix(path, prefix) && (len(path) == len(prefix) || prefix == "" || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/') {
+		return len(prefix)
+	}
+	return -1
+}
+
+func matchesValue(values []string, want string) bool {
+	for _, value := range values {
+		if want == "*" || value == want {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesRequest tells whether the request meets the method, header, cookie
+// and query conditions of the route
+func (r *Route) matchesRequest(req *http.Request) bool {
+	if len(r.Methods) > 0 {
+		found := false
+		for _, method := range r.Methods {
+			found = found || strings.EqualFold(method, req.Method)
+		}
+		if !found {
+			return false
+		}
+	}
+	for name, want := range r.Headers {
+		if !matchesValue(req.Header[http.CanonicalHeaderKey(name)], want) {
+			return false
+		}
+	}
+	for name, want := range r.Cookies {
+		cookie, err := req.Cookie(name)
+		if err != nil || !matchesValue([]string{cookie.Value}, want) {
+			return false
+		}
+	}
+	if len(r.Query) > 0 {
+		query := req.URL.Query()
+		for name, want := range r.Query {
+			if !matchesValue(query[name], want) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// rank orders the routes of a host matching a request
+type rank struct {
+	priority, path, conditions int
+}
+
+func (a rank) above(b rank) bool {
+	if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+	if a.path != b.path {
+		return a.path > b.path
+	}
+	return a.conditions > b.conditions
+}
+
+// rank tells whether the route matches the request, and how well
+func (r *Route) rank(req *http.Request) (rank, bool) {
+	path := r.matchPath(req.URL.Path)
+	if path < 0 || !r.matchesRequest(req) {
+		return rank{}, false
+	}
+	conditions := len(r.Headers) + len(r.Cookies) + len(r.Query)
+	if len(r.Methods) > 0 {
+		conditions++
+	}
+	return rank{r.Priority, path, conditions}, true
+}
+
+// RewritePath returns the path to forward the request with, once the matched
+// part is stripped or rewritten.
+func (r *Route) RewritePath(path string) string {
+	if !r.StripPrefix && r.Rewrite == "" {
+		return path
+	}
+	rewritten := path
+	if r.PathRegex != "" {
+		re, err := pathRegexp(r.PathRegex)
+		if err != nil {
+			return path
+		}
+		match := re.FindStringSubmatchIndex(path)
+		if match == nil {
+			return path
+		}
+		rewritten = string(re.ExpandString(nil, r.Rewrite, path, match)) + path[match[1]:]
+	} else if strings.HasPrefix(path, r.PathPrefix) {
+		rewritten = r.Rewrite + path[len(r.PathPrefix):]
+	}
+	if !strings.HasPrefix(rewritten, "/") {
+		rewritten = "/" + rewritten
+	}
+	return rewritten
+}
+
+// Destination is where a request is proxied to.
+type Destination struct {
+	// Route is the route the request matched, nil when the resolver fell
+	// back to deriving the destination from the host name
+	Route *Route
+	// HostPort is the first of the endpoints
+	HostPort string
+	// Endpoints are the dsthost:dstport of every backend serving the
+	// destination, such as the replicas of a scaled service. The proxy
+	// balances requests across them.
+	Endpoints []string
+	// Stack is the stack picked for the request when the traffic of the
+	// deployment is split between several stacks
+	Stack string
+}
+
+func newDestination(route *Route, endpoints ...string) Destination {
+	return Destination{Route: route, HostPort: endpoints[0], Endpoints: endpoints}
+}
+
+// ParseProxyMappings parses whitespace separated mappings in the
+// [srchost:]dsthost[:dstport] format into routes.
+func ParseProxyMappings(mappings string) []Route {
+	routes := []Route{}
+	for _, mapping := range strings.Fields(mappings) {
+		hhp := strings.Split(mapping, ":")
+
+		if _, err := strconv.Atoi(hhp[len(hhp)-1]); err != nil {
+			hhp = append(hhp, "80")
+		}
+		if len(hhp) > 3 {
+			log.Printf("Wrong mapping format '%s' expected [srchost:]dsthost[:destport]", mapping)
+			continue
+		}
+		if len(hhp) == 2 {
+			hhp = []string{hhp[0], hhp[0], hhp[1]}
+		}
+		port, _ := strconv.Atoi(hhp[2])
+		routes = append(routes, Route{Name: hhp[0], Host: hhp[0], Destination: hhp[1], Port: uint16(port)})
+	}
+	return routes
+}
+
+// routeTable is an immutable set of routes keyed by source host. A new table
+// is built on every change, so lookups never see a half updated table.
+type routeTable struct {
+	routes []Route
+	// hosts holds the routes of each host, longest path prefix first
+	hosts map[string][]*Route
+	// clientCAHosts are the lowercased hosts with a route requiring a client
+	// certificate
+	clientCAHosts map[string]bool
+}
+
+func newRouteTable(routes []Route) *routeTable {
+	t := &routeTable{routes: routes, hosts: map[string][]*Route{}, clientCAHosts: map[string]bool{}}
+	for n := range routes {
+		route := &routes[n]
+		if route.ClientCA != "" {
+			t.clientCAHosts[strings.ToLower(route.Host)] = true
+		}
+		hostRoutes := t.hosts[route.Host]
+		for i, existing := range hostRoutes {
+			// later routes override earlier ones
+			if existing.matchKey() == route.matchKey() {
+				hostRoutes = append(hostRoutes[:i], hostRoutes[i+1:]...)
+				break
+			}
+		}
+		hostRoutes = append(hostRoutes, route)
+		sort.SliceStable(hostRoutes, func(i, j int) bool {
+			return len(hostRoutes[i].PathPrefix) > len(hostRoutes[j].PathPrefix)
+		})
+		t.hosts[route.Host] = hostRoutes
+	}
+	return t
+}
+
+// match returns the route of the given source host ranking first for the
+// request
+func (t *routeTable) match(host string, r *http.Request) (*Route, bool) {
+	var matched *Route
+	var best rank
+	for _, route := range t.hosts[host] {
+		if rank, ok := route.rank(r); ok && (matched == nil || rank.above(best)) {
+			matched, best = route, rank
+		}
+	}
+	return matched, matched != nil
+}
+
+// hasHost tells whether routes are configured for the source host
+func (t *routeTable) hasHost(host string) bool {
+	return len(t.hosts[host]) > 0
+}
+
+// wantsClientCert tells whether a route requiring a client certificate
+// matches the host, in full or by its first labels
+func (t *routeTable) wantsClientCert(host string) bool {
+	host = strings.ToLower(host)
+	if t.clientCAHosts[host] {
+		return true
+	}
+	for src := range t.clientCAHosts {
+		if strings.HasPrefix(host, src+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// all returns the routes in effect, leaving out the overridden ones
+func (t *routeTable) all() []*Route {
+	routes := []*Route{}
+	for _, hostRoutes := range t.hosts {
+		routes = append(routes, hostRoutes...)
+	}
+	return routes
+}
+
+// byKey returns the routes by host and path prefix
+func (t *routeTable) byKey() map[string]*Route {
+	routes := map[string]*Route{}
+	for host, hostRoutes := range t.hosts {
+		for _, route := range hostRoutes {
+			routes[host+route.matchKey()] = route
+		}
+	}
+	return routes
+}
+
+// diff describes the routes added, removed or changed in next.
+func (t *routeTable) diff(next *routeTable) []string {
+	lines := []string{}
+	current, upcoming := t.byKey(), next.byKey()
+	for key, route := range upcoming {
+		previous, found := current[key]
+		if !found {
+			lines = append(lines, fmt.Sprintf("Route added: %s", route))
+			continue
+		}
+		if !reflect.DeepEqual(previous, route) {
+			lines = append(lines, fmt.Sprintf("Route changed: %s (was %s)", route, previous.Target()))
+		}
+	}
+	for key, route := range current {
+		if _, found := upcoming[key]; !found {
+			lines = append(lines, fmt.Sprintf("Route removed: %s", route))
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// routeStore publishes the route table of a resolver. Routes can be replaced
+// at any time, requests already resolved keep using the table they got.
+type routeStore struct {
+	// mappings holds the proxy-mappings flag, which is merged on top of the
+	// configured routes
+	mappings string
+
+	mu    sync.Mutex
+	table atomic.Value
+}
+
+func (s *routeStore) routeTable() *routeTable {
+	if table, ok := s.table.Load().(*routeTable); ok {
+		return table
+	}
+	return newRouteTable(nil)
+}
+
+// SetRoutes replaces the configured routes and logs what changed.
+func (s *routeStore) SetRoutes(routes []Route) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := newRouteTable(append(append([]Route{}, routes...), ParseProxyMappings(s.mappings)...))
+	previous := s.routeTable()
+	s.table.Store(next)
+	for _, line := range previous.diff(next) {
+		log.Println(line)
+	}
+}
@@ -0,0 +1,143 @@
+package resolver
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRouteTableLongestMatch(t *testing.T) {
+	table := newRouteTable([]Route{
+		{Host: "app", Destination: "spa", Port: 80},
+		{Host: "app", Destination: "api", Port: 3000, PathPrefix: "/api"},
+		{Host: "app", Destination: "api-v2", Port: 3000, PathRegex: `/api/v[2-9]/`},
+		{Host: "app", Destination: "ws", Port: 8080, PathPrefix: "/api/v2/ws"},
+	})
+
+	for path, destination := range map[string]string{
+		"/":              "spa",
+		"/index.html":    "spa",
+		"/api/v1/orders": "api",
+		"/api/v2/orders": "api-v2",
+		"/api/v2/ws":     "ws",
+		"/app/api/v2/":   "spa",
+		"/api":           "api",
+		"/apiary":        "spa",
+	} {
+		route, ok := table.match("app", HostRequest("app", path))
+		if !ok || route.Destination != destination {
+			t.Errorf("Expected %s to route to %s, got: %v", path, destination, route)
+		}
+	}
+}
+
+func TestRouteRewritePath(t *testing.T) {
+	for _, test := range []struct {
+		route      Route
+		path, want string
+	}{
+		{Route{PathPrefix: "/api"}, "/api/orders", "/api/orders"},
+		{Route{PathPrefix: "/api", StripPrefix: true}, "/api/orders", "/orders"},
+		{Route{PathPrefix: "/api", StripPrefix: true}, "/api", "/"},
+		{Route{PathPrefix: "/api/", Rewrite: "/v1/"}, "/api/orders", "/v1/orders"},
+		{Route{PathRegex: `/api/v(\d+)`, Rewrite: "/version$1"}, "/api/v2/orders", "/version2/orders"},
+		{Route{PathRegex: `/[a-z]{2}/`, StripPrefix: true}, "/en/about", "/about"},
+	} {
+		if got := test.route.RewritePath(test.path); got != test.want {
+			t.Errorf("Expected %s to be rewritten to %s by %+v, got: %s", test.path, test.want, test.route, got)
+		}
+	}
+}
+
+func TestRouteValidate(t *testing.T) {
+	if err := (&Route{Host: "app", PathRegex: "/api/("}).Validate(); err == nil {
+		t.Errorf("Invalid path regexes should be rejected")
+	}
+	if err := (&Route{Host: "app", PathPrefix: "/api", PathRegex: "/api"}).Validate(); err == nil {
+		t.Errorf("Routes should not set both a path prefix and regex")
+	}
+}
+
+func TestRouteTableConditions(t *testing.T) {
+	table := newRouteTable([]Route{
+		{Host: "app", Destination: "default"},
+		{Host: "app", Destination: "preview", Cookies: map[string]string{"stack": "feature-42"}},
+		{Host: "app", Destination: "canary", Headers: map[string]string{"x-canary": "1"}},
+		{Host: "app", Destination: "debug", Query: map[string]string{"debug": "*"}},
+		{Host: "app", Destination: "writes", PathPrefix: "/api", Methods: []string{"post", "PUT"}},
+		{Host: "app", Destination: "maintenance", PathPrefix: "/api", Headers: map[string]string{"X-Maintenance": "*"}, Priority: 10},
+	})
+
+	request := func(method, path string, header ...string) *http.Request {
+		r := HostRequest("app", path)
+		r.Method = method
+		if q := strings.Index(path, "?"); q >= 0 {
+			r.URL.Path, r.URL.RawQuery = path[:q], path[q+1:]
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Add(header[i], header[i+1])
+		}
+		return r
+	}
+	for _, test := range []struct {
+		request     *http.Request
+		destination string
+	}{
+		{request("GET", "/"), "default"},
+		{request("GET", "/", "Cookie", "stack=feature-42"), "preview"},
+		{request("GET", "/", "Cookie", "stack=feature-7"), "default"},
+		{request("GET", "/", "X-Canary", "1"), "canary"},
+		{request("GET", "/?debug"), "debug"},
+		{request("GET", "/api/orders"), "default"},
+		{request("POST", "/api/orders"), "writes"},
+		{request("POST", "/api/orders", "X-Maintenance", "yes"), "maintenance"},
+		{request("GET", "/", "X-Maintenance", "yes"), "default"},
+	} {
+		route, ok := table.match("app", test.request)
+		if !ok || route.Destination != test.destination {
+			t.Errorf("Expected %s %s %v to route to %s, got: %v", test.request.Method, test.request.URL, test.request.Header, test.destination, route)
+		}
+	}
+
+	if routes := len(table.all()); routes != 6 {
+		t.Errorf("Routes with different conditions should not override each other, got %d routes", routes)
+	}
+}
+
+func TestRouteTableDiff(t *testing.T) {
+	current := []Route{
+		{Host: "app", Destination: "spa", Port: 80},
+		{Host: "app", Destination: "api", Port: 3000, PathPrefix: "/api"},
+		{Host: "shop", Destination: "shop", Port: 80},
+	}
+	for _, test := range []struct {
+		name  string
+		next  []Route
+		lines []string
+	}{
+		{"unchanged", current, []string{}},
+		{"added", append(current[:3:3], Route{Host: "admin", Destination: "admin", Port: 8080}), []string{
+			"Route added: admin -> admin:8080",
+		}},
+		{"removed", current[:2], []string{
+			"Route removed: shop -> shop:80",
+		}},
+		{"changed", []Route{current[0], {Host: "app", Destination: "api-v2", Port: 3000, PathPrefix: "/api"}, current[2]}, []string{
+			"Route changed: app/api -> api-v2:3000 (was api:3000)",
+		}},
+		{"conditions", append(current[:3:3], Route{Host: "shop", Destination: "shop-canary", Port: 80, Headers: map[string]string{"X-Canary": "1"}}), []string{
+			"Route added: shop [header:X-Canary=1] -> shop-canary:80",
+		}},
+		{"everything", nil, []string{
+			"Route removed: app -> spa:80",
+			"Route removed: app/api -> api:3000",
+			"Route removed: shop -> shop:80",
+		}},
+	} {
+		lines := newRouteTable(current).diff(newRouteTable(test.next))
+		if !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("%s: expected %q, got %q", test.name, test.lines, lines)
+		}
+	}
+}
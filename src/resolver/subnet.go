@@ -4,76 +4,96 @@ import (
 	"errors"
 	"fmt"
 	"github.com/namsral/flag"
-	"log"
-	"strconv"
+	"net/http"
 	"strings"
 )
 
 type Subnet struct {
+	// Routes are proxied in addition to the proxy-mappings flag
+	Routes []Route
+
+	routeStore
 	proxyOnlyMappedHosts bool
-	proxyMappings        map[string]string
 }
 
 func (s *Subnet) Configure() {
 	flag.BoolVar(&s.proxyOnlyMappedHosts, "proxy-only-mapped-hosts", false, "Only hosts specified in proxy mapping will be proxied")
 
-	var mappings string
-	flag.StringVar(&mappings, "proxy-mappings", "", "Manually specify mappings")
+	flag.StringVar(&s.mappings, "proxy-mappings", "", "Manually specify mappings")
 	flag.Parse()
 
-	s.proxyMappings = s.parseProxyMappings(mappings)
-	//resolver.SetProxyMappings(strings.Fields(mappings))
+	s.SetRoutes(s.Routes)
 }
 func (s *Subnet) GetName() string {
 	return "subnet"
 }
 
-func (s *Subnet) parseProxyMappings(mappings string) map[string]string {
-	proxyMap := make(map[string]string)
-	for _, mapping := range strings.Fields(mappings) {
-		hhp := strings.Split(mapping, ":")
+func (s *Subnet) Resolve(r *http.Request) (Destination, error) {
+	return s.resolve(r)
+}
 
-		if _, err := strconv.Atoi(hhp[len(hhp)-1]); err != nil {
-			hhp = append(hhp, "80")
-		}
-		if len(hhp) > 3 {
-			log.Printf("Wrong mapping format '%s' expected [srchost:]dsthost[:destport]", mapping)
-			continue
-		}
-		if len(hhp) == 2 {
-			hhp = []string{hhp[0], hhp[0], hhp[1]}
+func (s *Subnet) Destinations() []Destination {
+	destinations := []Destination{}
+	for _, route := range s.routeTable().all() {
+		destinations = append(destinations, newDestination(route, route.Target()))
+	}
+	return destinations
+}
+
+// Routable tells whether a route matches the host, the way resolve looks them
+// up. Hosts only the fallback would proxy are not routed.
+func (s *Subnet) Routable(host string) bool {
+	host = strings.Split(host, ":")[0]
+	routes := s.routeTable()
+	if routes.hasHost(host) || routes.hasHost(strings.Split(host, ".")[0]) {
+		return true
+	}
+	for src := range routes.hosts {
+		if strings.HasPrefix(host, src+".") {
+			return true
 		}
-		proxyMap[hhp[0]] = fmt.Sprintf("%s:%s", hhp[1], hhp[2])
 	}
-	return proxyMap
+	return false
+}
+
+func (s *Subnet) WantsClientCert(host string) bool {
+	return s.routeTable().wantsClientCert(host)
 }
 
 func (s *Subnet) GetDestinationHostPort(sourceHostPort string) (dstHostPort string, err error) {
-	sourceHost := strings.Split(sourceHostPort, ":")[0]
+	destination, err := s.resolve(HostRequest(sourceHostPort, "/"))
+	return destination.HostPort, err
+}
+
+func (s *Subnet) resolve(r *http.Request) (Destination, error) {
+	sourceHost := strings.Split(r.Host, ":")[0]
+	routes := s.routeTable()
 
 	// Full host matching
-	if dstHostPort, ok := s.proxyMappings[sourceHost]; ok {
-		return dstHostPort, nil
+	if route, ok := routes.match(sourceHost, r); ok {
+		return newDestination(route, route.Target()), nil
 	}
 
 	// First part of host matching
 	srcHost := strings.Split(sourceHost, ".")[0]
-	if dstHostPort, ok := s.proxyMappings[srcHost]; ok {
-		return dstHostPort, nil
+	if route, ok := routes.match(srcHost, r); ok {
+		return newDestination(route, route.Target()), nil
 	}
 
 	// Arbitrary number of host parts matching
-	for src, dst := range s.proxyMappings {
+	for src := range routes.hosts {
 		if strings.HasPrefix(sourceHost, src+".") {
-			return dst, nil
+			if route, ok := routes.match(src, r); ok {
+				return newDestination(route, route.Target()), nil
+			}
 		}
 	}
 
 	// Don't assume fallback, if we only proxy mapped hosts
 	if s.proxyOnlyMappedHosts {
-		return "", errors.New(fmt.Sprintf("Only configured gateways allowed ('%s' not found)", srcHost))
+		return Destination{}, errors.New(fmt.Sprintf("Only configured gateways allowed ('%s' not found)", srcHost))
 	}
 
 	// Fallback, assume first part host exists
-	return fmt.Sprintf("%s:%d", srcHost, 80), nil
+	return newDestination(nil, fmt.Sprintf("%s:%d", srcHost, 80)), nil
 }
@@ -0,0 +1,20 @@
+package resolver
+
+import "testing"
+
+func TestSubnetRoutes(t *testing.T) {
+	s := &Subnet{}
+	s.SetRoutes(ParseProxyMappings("shop:shop-web:80 redis:redis-commander:8081"))
+
+	for host, routed := range map[string]bool{
+		"shop":                  true,
+		"shop.example.test":     true,
+		"redis.internal:443":    true,
+		"shopping.example.test": false,
+		"unknown.example.test":  false,
+	} {
+		if s.Routable(host) != routed {
+			t.Errorf("Expected %s to be routed: %v", host, routed)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// RetryPolicy resends requests that failed to reach the backend, which is
+// what a browser sees while a stack is being redeployed. Each request may be
+// retried Attempts times, waiting Backoff before the first retry and twice as
+// long before each next one.
+type RetryPolicy struct {
+	Attempts int
+	Backoff  time.Duration
+}
+
+func (p *RetryPolicy) allows(retries int) bool {
+	return p != nil && retries < p.Attempts
+}
+
+func (p *RetryPolicy) backoff(retries int) time.Duration {
+	return p.Backoff << uint(retries)
+}
+
+// idempotent methods may be sent again whatever happened to the first attempt
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// retryable tells whether the request can be sent again after it failed with
+// err. Any method can be retried as long as nothing reached the backend.
+func retryable(request *http.Request, body *unreadBody, err error) bool {
+	if body != nil && atomic.LoadInt32(&body.read) == 1 {
+		return false
+	}
+	if idempotent(request.Method) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// nextEndpoint returns an endpoint that was not tried yet, or the current one
+// when all have been.
+func nextEndpoint(endpoints []string, tried map[string]bool, current string) string {
+	for _, endpoint := range endpoints {
+		if !tried[endpoint] {
+			return endpoint
+		}
+	}
+	return current
+}
+
+// sleep waits for d, unless the request is canceled first
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// unreadBody keeps a request body around for retries. The transport closes
+// the body of a failed request, so closing is left to the server; a body
+// that was read from can not be sent again.
+type unreadBody struct {
+	io.ReadCloser
+	// read is set from the transport's own goroutine
+	read int32
+}
+
+func (b *unreadBody) Read(p []byte) (int, error) {
+	atomic.StoreInt32(&b.read, 1)
+	return b.ReadCloser.Read(p)
+}
+
+func (b *unreadBody) Close() error {
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTransportRetriesOnAnotherEndpoint(t *testing.T) {
+	attempts := []string{}
+	transport := errorHandlingTransport{
+		RoundTripper: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			attempts = append(attempts, r.URL.Host)
+			if r.URL.Host == "a:80" {
+				return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			return &http.Response{StatusCode: 200, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(string(body)))}, nil
+		}),
+		retries: &RetryPolicy{Attempts: 2},
+	}
+
+	r, info := withRequestInfo(httptest.NewRequest("POST", "http://a:80/orders", strings.NewReader("order")))
+	info.Endpoints = []string{"a:80", "b:80"}
+	resp, err := transport.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(body) != "order" || strings.Join(attempts, " ") != "a:80 b:80" {
+		t.Errorf("Expected the request and its body to be sent to b:80 after a:80 refused it, got %d %q after %v", resp.StatusCode, body, attempts)
+	}
+	if resp.Header.Get("X-Gateway-Retries") != "1" || info.Destination != "b:80" {
+		t.Errorf("Expected the retry to be reported, got %q to %s", resp.Header.Get("X-Gateway-Retries"), info.Destination)
+	}
+}
+
+func TestTransportRetryBudget(t *testing.T) {
+	attempts := 0
+	transport := errorHandlingTransport{
+		RoundTripper: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			attempts++
+			return nil, errors.New("connection reset by peer")
+		}),
+		retries: &RetryPolicy{Attempts: 2},
+	}
+
+	resp, _ := transport.RoundTrip(httptest.NewRequest("GET", "http://a:80/", nil))
+	if resp.StatusCode != 502 || attempts != 3 || resp.Header.Get("X-Gateway-Retries") != "2" {
+		t.Errorf("Expected a 502 after 2 retries, got %d after %d attempts", resp.StatusCode, attempts)
+	}
+
+	// the request may have reached the backend before the connection broke
+	attempts = 0
+	resp, _ = transport.RoundTrip(httptest.NewRequest("POST", "http://a:80/", nil))
+	if resp.StatusCode != 502 || attempts != 1 {
+		t.Errorf("Expected a POST not to be retried once sent, got %d attempts", attempts)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing exporters
+const (
+	otlpExporter = "otlp"
+	fileExporter = "file"
+)
+
+// tracer returns the tracer of the installed provider, a no-op one until
+// setupTracing is called
+func tracer() trace.Tracer {
+	return otel.Tracer("gateway")
+}
+
+// TracingConfig tells where spans are exported to.
+type TracingConfig struct {
+	// Exporter is otlp, file, or empty to disable tracing
+	Exporter string
+	// Endpoint is the OTLP/HTTP collector url, File the file spans are
+	// written to as JSON
+	Endpoint    string
+	File        string
+	ServiceName string
+	// SampleRatio is the share of traces started by the gateway that are
+	// sampled, traces started upstream follow the decision of their parent
+	SampleRatio float64
+}
+
+// setupTracing installs the tracer provider and the W3C trace context
+// propagator. The returned function flushes the spans not exported yet.
+func setupTracing(config TracingConfig) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.Exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case otlpExporter:
+		exporter, err = otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(config.Endpoint))
+	case fileExporter:
+		var file *os.File
+		if file, err = os.OpenFile(config.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err == nil {
+			exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+		}
+	default:
+		return nil, fmt.Errorf("Unknown tracing exporter '%s' (%s, %s)", config.Exporter, otlpExporter, fileExporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", config.ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// traceRequests starts a server span for every request served by h,
+// continuing the trace of the traceparent header when there is one.
+func traceRequests(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r, info := withRequestInfo(r)
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer().Start(ctx, r.Method+" "+r.Host, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("server.address", r.Host),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("client.address", stripPort(r.RemoteAddr)),
+		))
+		defer span.End()
+		rw := &recordingResponseWriter{ResponseWriter: w, body: &captureBuffer{}}
+
+		h(rw, r.WithContext(ctx))
+
+		status := rw.statusCode()
+		span.SetAttributes(
+			attribute.Int("http.response.status_code", status),
+			attribute.String("gateway.route", info.RouteName),
+			attribute.String("gateway.destination", info.Destination),
+			attribute.String("gateway.request_id", info.RequestID),
+		)
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// injectTrace adds the trace context of ctx to the headers of an outgoing
+// request.
+func injectTrace(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
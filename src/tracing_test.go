@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"gateway/resolver"
+)
+
+func TestTraceProxiedRequest(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+
+	traceparent := ""
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer backend.Close()
+	subnet := &resolver.Subnet{}
+	subnet.SetRoutes(resolver.ParseProxyMappings("shop:" + strings.TrimPrefix(backend.URL, "http://")))
+	ps := &ProxyServer{destinationResolver: subnet}
+
+	r := httptest.NewRequest("GET", "http://shop/orders", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	traceRequests(ps.Handler)(httptest.NewRecorder(), r)
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[strings.Fields(span.Name)[0]] = span
+	}
+	server, resolve, upstream := spans["GET"], spans["resolve"], spans["upstream"]
+	if server.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || server.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Fatalf("Expected the server span to continue the incoming trace, got %+v", server)
+	}
+	if resolve.Parent.SpanID() != server.SpanContext.SpanID() || upstream.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Errorf("Expected resolution and upstream spans under the server span, got %v", exporter.GetSpans())
+	}
+	if !strings.Contains(traceparent, upstream.SpanContext.SpanID().String()) {
+		t.Errorf("Expected the backend to get the upstream span as parent, got %q", traceparent)
+	}
+}
+
+func TestTraceOTLPExport(t *testing.T) {
+	posted := make(chan string, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted <- r.Method + " " + r.URL.Path + " " + r.Header.Get("Content-Type")
+	}))
+	defer collector.Close()
+
+	shutdown, err := setupTracing(TracingConfig{Exporter: otlpExporter, Endpoint: collector.URL, ServiceName: "gateway", SampleRatio: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	_, span := tracer().Start(context.Background(), "test")
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if request := <-posted; request != "POST /v1/traces application/x-protobuf" {
+		t.Errorf("Expected the span to be posted to the collector, got %s", request)
+	}
+}